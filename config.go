@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+/**
+ * The config file is written in TOML:
+ *
+ *     # Settings outside of a table are shared by all profiles
+ *     artifact_cache_size = "2G"
+ *
+ *     [profiles.default]
+ *     url = "https://gitlab.example.com"
+ *     token_command = "pass show gitlab"
+ *
+ *     [profiles.work]
+ *     url = "https://gitlab.work.example"
+ *     token_file = "~/.config/gitlab-fuse/work-token"
+ *     include_projects = ["infra/*", "tools/*"]
+ *     subtrees = ["repo", "jobs", "pipelines"]
+ *
+ * Settings are strings, numbers, booleans, or lists of strings. Durations and
+ * sizes are strings, e.g. "30s" or "2G".
+ */
+
+// configKeys are the settings a profile can hold. The value is true for those
+// which take a list.
+var configKeys = map[string]bool{
+	"url":                                 false,
+	"token":                               false,
+	"token_file":                          false,
+	"token_env":                           false,
+	"token_command":                       false,
+	"debug":                               false,
+	"fusedebug":                           false,
+	"min_namespace_dir_update_delay":      false,
+	"min_jobs_dir_update_delay":           false,
+	"min_refs_dir_update_delay":           false,
+	"min_trace_update_delay":              false,
+	"min_pipelines_dir_update_delay":      false,
+	"min_merge_requests_dir_update_delay": false,
+	"min_issues_dir_update_delay":         false,
+	"max_attempts":                        false,
+	"requests_per_second":                 false,
+	"artifact_cache_dir":                  false,
+	"artifact_cache_size":                 false,
+	"groups":                              true,
+	"membership":                          false,
+	"owned":                               false,
+	"starred":                             false,
+	"archived":                            false,
+	"min_access_level":                    false,
+	"include_projects":                    true,
+	"exclude_projects":                    true,
+	"subtrees":                            true,
+	"instances":                           true,
+}
+
+type configValue struct {
+	str  string
+	list []string
+	pos  string // The file and profile it is set in, for error messages
+}
+
+// profile holds the settings of a profile, including the ones shared by all
+// profiles.
+type profile map[string]configValue
+
+// str returns a single-valued setting.
+func (p profile) str(key string) (string, bool) {
+	v, ok := p[key]
+	return v.str, ok
+}
+
+// list returns a setting which takes a list.
+func (p profile) list(key string) []string {
+	return p[key].list
+}
+
+// bool returns a boolean setting, or def if it is not set.
+func (p profile) bool(key string, def bool) (bool, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v.str)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s: expected true or false", v.pos, key)
+	}
+	return b, nil
+}
+
+// defaultConfigPath returns ~/.config/gitlab-fuse/config (or the equivalent
+// under $XDG_CONFIG_HOME).
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gitlab-fuse", "config")
+}
+
+// loadProfile reads the named profile from the config file at path. An empty
+// name selects the "default" profile, if there is one. A missing config file
+// is only an error if the file or a profile was asked for explicitly.
+func loadProfile(path, name string, required bool) (profile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required && name == "" {
+			return profile{}, nil
+		}
+		return nil, err
+	}
+
+	shared, profiles, err := parseConfig(path, string(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	p := profile{}
+	for k, v := range shared {
+		p[k] = v
+	}
+
+	own, ok := profiles[name]
+	if name == "" {
+		own = profiles["default"]
+	} else if !ok {
+		return nil, fmt.Errorf("%s: no profile %q", path, name)
+	}
+	for k, v := range own {
+		p[k] = v
+	}
+
+	return p, nil
+}
+
+// parseConfig parses the contents of a config file, returning the settings
+// shared by all profiles and those of each profile.
+func parseConfig(path, text string) (profile, map[string]profile, error) {
+	var file map[string]interface{}
+	if _, err := toml.Decode(text, &file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	profiles := make(map[string]profile)
+	if v, ok := file["profiles"]; ok {
+		tables, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: profiles: expected tables [profiles.<name>]", path)
+		}
+		for name, v := range tables {
+			table, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: profiles.%s: expected a table [profiles.%s]", path, name, name)
+			}
+			p, err := newProfile(fmt.Sprintf("%s: profile %q", path, name), table)
+			if err != nil {
+				return nil, nil, err
+			}
+			profiles[name] = p
+		}
+		delete(file, "profiles")
+	}
+
+	shared, err := newProfile(path, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shared, profiles, nil
+}
+
+// newProfile checks the settings of a table, and converts them into a profile.
+func newProfile(pos string, table map[string]interface{}) (profile, error) {
+	// Sorted, so that the same error is reported each time
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	p := profile{}
+	for _, key := range keys {
+		isList, known := configKeys[key]
+		if !known {
+			return nil, fmt.Errorf("%s: unknown setting %q", pos, key)
+		}
+		v, err := settingValue(table[key], isList)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", pos, key, err)
+		}
+		v.pos = pos
+		p[key] = v
+	}
+	return p, nil
+}
+
+// settingValue converts the value of a setting as decoded from TOML. Single
+// values are kept as strings, and parsed like the environment variables.
+func settingValue(value interface{}, isList bool) (configValue, error) {
+	var v configValue
+
+	if isList {
+		items, ok := value.([]interface{})
+		if !ok {
+			return v, errors.New("expected a list of strings")
+		}
+		v.list = make([]string, len(items))
+		for i, item := range items {
+			if v.list[i], ok = item.(string); !ok {
+				return v, errors.New("expected a list of strings")
+			}
+		}
+		return v, nil
+	}
+
+	switch value := value.(type) {
+	case string:
+		v.str = value
+	case bool:
+		v.str = strconv.FormatBool(value)
+	case int64:
+		v.str = strconv.FormatInt(value, 10)
+	case float64:
+		v.str = strconv.FormatFloat(value, 'g', -1, 64)
+	default:
+		return v, errors.New("expected a string, number or boolean")
+	}
+	return v, nil
+}
+
+// expandHome replaces a leading ~/ in path with the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with the given contents to a temporary
+// directory, and returns its path.
+func writeConfig(t *testing.T, text string) string {
+	dir, err := ioutil.TempDir("", "gitlab-fuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets an environment variable for the rest of the test.
+func setenv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+const testConfig = `
+artifact_cache_size = "2G"
+min_jobs_dir_update_delay = "30s"
+groups = ["shared"]
+
+[profiles.default]
+url = "https://gitlab.example.com"
+token = "default-token"
+
+[profiles.work]
+url = "https://gitlab.work.example"
+token_env = "WORK_TOKEN"
+min_jobs_dir_update_delay = "5m"
+groups = ["infra", "tools"]
+max_attempts = 5
+requests_per_second = 2.5
+debug = true
+`
+
+func TestLoadProfile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+
+	tests := []struct {
+		name  string
+		strs  map[string]string
+		lists map[string][]string
+	}{
+		{"", map[string]string{
+			"url":                       "https://gitlab.example.com",
+			"token":                     "default-token",
+			"artifact_cache_size":       "2G",
+			"min_jobs_dir_update_delay": "30s",
+		}, map[string][]string{"groups": {"shared"}}},
+		{"default", map[string]string{
+			"url":   "https://gitlab.example.com",
+			"token": "default-token",
+		}, nil},
+		{"work", map[string]string{
+			"url":                       "https://gitlab.work.example",
+			"token_env":                 "WORK_TOKEN",
+			"artifact_cache_size":       "2G",
+			"min_jobs_dir_update_delay": "5m",
+			"max_attempts":              "5",
+			"requests_per_second":       "2.5",
+			"debug":                     "true",
+		}, map[string][]string{"groups": {"infra", "tools"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run("profile "+tt.name, func(t *testing.T) {
+			p, err := loadProfile(path, tt.name, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.strs {
+				if got, ok := p.str(key); !ok || got != want {
+					t.Errorf("%s = %q (set: %v), want %q", key, got, ok, want)
+				}
+			}
+			for key, want := range tt.lists {
+				if got := p.list(key); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+
+	// Settings of one profile don't leak into another
+	p, err := loadProfile(path, "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.str("token_env"); ok {
+		t.Error("token_env of profile work set in profile default")
+	}
+}
+
+func TestLoadProfileErrors(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "gitlab-fuse-test-missing", "config")
+
+	tests := []struct {
+		name     string
+		text     string // The config file, or "" for none
+		profile  string
+		required bool
+		err      string // Expected in the error, or "" for none
+	}{
+		{"missing file", "", "", false, ""},
+		{"missing file asked for", "", "", true, "no such file"},
+		{"missing file with profile", "", "work", false, "no such file"},
+		{"no default profile", `url = "https://gitlab.example.com"`, "", false, ""},
+		{"missing profile", testConfig, "home", false, `no profile "home"`},
+		{"syntax error", "url = ", "", false, "config"},
+		{"unknown setting", `urls = "https://gitlab.example.com"`, "", false, `unknown setting "urls"`},
+		{"unknown setting in profile", "[profiles.work]\ntokn = \"x\"", "work", false,
+			`profile "work": unknown setting "tokn"`},
+		{"string for list", `groups = "infra"`, "", false, "groups: expected a list of strings"},
+		{"numbers in list", `include_projects = [1, 2]`, "", false, "include_projects: expected a list of strings"},
+		{"list for string", `url = ["https://gitlab.example.com"]`, "", false,
+			"url: expected a string, number or boolean"},
+		{"table for string", "[token]\nvalue = \"x\"", "", false, "token: expected a string, number or boolean"},
+		{"profiles not tables", `profiles = "work"`, "", false, "profiles: expected tables"},
+		{"profile not a table", "[profiles]\nwork = 1", "work", false, "profiles.work: expected a table"},
+		{"wrong type in other profile", "[profiles.a]\nurl = \"x\"\n[profiles.b]\ngroups = 1", "a", false,
+			`profile "b": groups: expected a list of strings`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := missing
+			if tt.text != "" {
+				path = writeConfig(t, tt.text)
+			}
+
+			_, err := loadProfile(path, tt.profile, tt.required)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("error %v", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("no error, want %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("error %q, want %q in it", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestProfileBool(t *testing.T) {
+	path := writeConfig(t, `
+debug = true
+fusedebug = "yes"
+membership = "false"
+`)
+	p, err := loadProfile(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := p.bool("debug", false); err != nil || !b {
+		t.Errorf("debug = %v, %v; want true", b, err)
+	}
+	if b, err := p.bool("membership", true); err != nil || b {
+		t.Errorf("membership = %v, %v; want false", b, err)
+	}
+	if b, err := p.bool("owned", true); err != nil || !b {
+		t.Errorf("owned (unset) = %v, %v; want the default, true", b, err)
+	}
+	if _, err := p.bool("fusedebug", false); err == nil || !strings.Contains(err.Error(), "fusedebug: expected true or false") {
+		t.Errorf("fusedebug error = %v, want expected true or false", err)
+	}
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+min_jobs_dir_update_delay = "30s"
+include_projects = ["infra/*", "tools/*"]
+`)
+	p, err := loadProfile(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From the config file, unless the environment variable is set
+	if got, _ := optionValue(p, "min_jobs_dir_update_delay"); got != "30s" {
+		t.Errorf("min_jobs_dir_update_delay = %q, want the config file's", got)
+	}
+	if got := optionList(p, "include_projects"); !reflect.DeepEqual(got, []string{"infra/*", "tools/*"}) {
+		t.Errorf("include_projects = %q, want the config file's", got)
+	}
+	if _, ok := optionValue(p, "min_refs_dir_update_delay"); ok {
+		t.Error("min_refs_dir_update_delay is set")
+	}
+
+	setenv(t, "GITLABFS_MIN_JOBS_DIR_UPDATE_DELAY", "5m")
+	setenv(t, "GITLABFS_INCLUDE_PROJECTS", "a/*,b")
+	if got, _ := optionValue(p, "min_jobs_dir_update_delay"); got != "5m" {
+		t.Errorf("min_jobs_dir_update_delay = %q, want the environment's", got)
+	}
+	if got := optionList(p, "include_projects"); !reflect.DeepEqual(got, []string{"a/*", "b"}) {
+		t.Errorf("include_projects = %q, want the environment's", got)
+	}
+
+	// An empty variable counts as unset
+	setenv(t, "GITLABFS_MIN_JOBS_DIR_UPDATE_DELAY", "")
+	if got, _ := optionValue(p, "min_jobs_dir_update_delay"); got != "30s" {
+		t.Errorf("min_jobs_dir_update_delay = %q, want the config file's", got)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	setenv(t, "WORK_TOKEN", "env-token")
+	path := writeConfig(t, testConfig+`
+[profiles.multi]
+instances = ["default", "work"]
+`)
+
+	type settings struct {
+		url, token       string
+		debug, fusedebug bool
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		setFlags []string
+		given    settings // From flags, or the environment
+		want     settings
+	}{
+		{"all from profile", "default", nil, settings{},
+			settings{"https://gitlab.example.com", "default-token", false, false}},
+		{"token from environment variable", "work", nil, settings{},
+			settings{"https://gitlab.work.example", "env-token", true, false}},
+		{"URL and token given", "work", []string{"url"},
+			settings{url: "https://other.example", token: "given-token"},
+			settings{"https://other.example", "given-token", true, false}},
+		{"debug flag given", "work", []string{"debug", "fusedebug"},
+			settings{debug: false, fusedebug: true},
+			settings{"https://gitlab.work.example", "env-token", false, true}},
+		{"instances", "multi", nil, settings{},
+			settings{"", "", false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := loadProfile(path, tt.profile, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setFlags := make(map[string]bool)
+			for _, name := range tt.setFlags {
+				setFlags[name] = true
+			}
+
+			got := tt.given
+			if err := applyProfile(p, setFlags, &got.url, &got.token, &got.debug, &got.fusedebug); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
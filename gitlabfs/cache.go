@@ -0,0 +1,423 @@
+package gitlabfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * The artifact cache keeps downloaded artifact archives of finished jobs on
+ * disk, since they never change. It is laid out like this:
+ * <dir>/
+ *     <host>/
+ *         <project_id>/
+ *             <job_id>         The archive
+ *             <job_id>.meta    JSON: size and SHA-256 of the archive
+ *
+ * Entries are only considered valid if both files exist and agree. On
+ * startup, this is checked using the size right away, and using the checksum
+ * in the background (or when an entry is first used, if that comes first).
+ * The access time of an entry is tracked using the archive's mtime, so that the
+ * LRU order survives remounts.
+ */
+
+// ArtifactCacheKey identifies a job's artifacts archive.
+type ArtifactCacheKey struct {
+	Host      string
+	ProjectID int
+	JobID     int
+}
+
+func (k ArtifactCacheKey) path() string {
+	return filepath.Join(url.PathEscape(k.Host), fmt.Sprint(k.ProjectID), fmt.Sprint(k.JobID))
+}
+
+type artifactCacheMeta struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type artifactCacheEntry struct {
+	path       string // relative to the cache dir, without extension
+	meta       artifactCacheMeta
+	lastAccess time.Time
+
+	// Whether the contents were checked against the checksum since we
+	// started
+	verified bool
+}
+
+type ArtifactCache struct {
+	dir     string
+	maxSize int64
+	debug   *log.Logger
+
+	// Problems found with the entries, for the .gitlabfs/errors of the
+	// instances using the cache
+	errors errorLog
+
+	mu      sync.Mutex
+	entries map[string]*artifactCacheEntry
+	size    int64
+
+	// Counts of the lookups which found an entry, or didn't
+	hits   int64
+	misses int64
+}
+
+// NewArtifactCache opens (creating if necessary) the artifact cache in dir,
+// which will be limited to maxSize bytes. Incomplete or inconsistent entries
+// left behind by a previous run are removed, and the remaining ones are
+// checked against their checksums in the background.
+func NewArtifactCache(dir string, maxSize int64) (*ArtifactCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &ArtifactCache{
+		dir:     dir,
+		maxSize: maxSize,
+		debug:   log.New(ioutil.Discard, "CACHE: ", log.Lshortfile|log.LstdFlags),
+		entries: make(map[string]*artifactCacheEntry),
+	}
+
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.evict("")
+	c.mu.Unlock()
+
+	go c.verifyAll()
+
+	return c, nil
+}
+
+func (c *ArtifactCache) SetDebugLogOutput(w io.Writer) {
+	c.debug.SetOutput(w)
+}
+
+// scan builds the index of cache entries from the files in the cache
+// directory, removing anything which isn't a complete entry.
+func (c *ArtifactCache) scan() error {
+	return filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+
+		// Temporary files of interrupted downloads
+		if strings.HasPrefix(fi.Name(), ".tmp-") {
+			c.errors.logf("Artifact cache: removing incomplete %s\n", rel)
+			return os.Remove(path)
+		}
+
+		if strings.HasSuffix(rel, ".meta") {
+			// Remove orphaned metadata
+			if _, err := os.Stat(strings.TrimSuffix(path, ".meta")); os.IsNotExist(err) {
+				c.errors.logf("Artifact cache: removing orphaned %s\n", rel)
+				return os.Remove(path)
+			}
+			return nil
+		}
+
+		var meta artifactCacheMeta
+		metaBuf, err := ioutil.ReadFile(path + ".meta")
+		if err == nil {
+			err = json.Unmarshal(metaBuf, &meta)
+		}
+		if err == nil && meta.Size != fi.Size() {
+			err = fmt.Errorf("size is %d, expected %d", fi.Size(), meta.Size)
+		}
+		if err != nil {
+			c.errors.logf("Artifact cache: removing invalid %s: %v\n", rel, err)
+			os.Remove(path + ".meta")
+			return os.Remove(path)
+		}
+
+		c.entries[rel] = &artifactCacheEntry{
+			path:       rel,
+			meta:       meta,
+			lastAccess: fi.ModTime(),
+		}
+		c.size += meta.Size
+		return nil
+	})
+}
+
+// remove deletes an entry. c.mu must be held.
+func (c *ArtifactCache) remove(e *artifactCacheEntry) {
+	c.debug.Printf("Removing %s (%d bytes)\n", e.path, e.meta.Size)
+
+	path := filepath.Join(c.dir, e.path)
+	os.Remove(path + ".meta")
+	os.Remove(path)
+
+	delete(c.entries, e.path)
+	c.size -= e.meta.Size
+}
+
+// evict removes the least recently used entries until the cache fits in
+// maxSize, except for the entry at keep. c.mu must be held.
+func (c *ArtifactCache) evict(keep string) {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	entries := make([]*artifactCacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	for _, e := range entries {
+		if c.size <= c.maxSize {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		c.remove(e)
+	}
+}
+
+// verify checks the contents of f against the entry's checksum.
+func (e *artifactCacheEntry) verify(f *os.File) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.meta.SHA256 {
+		return fmt.Errorf("checksum is %s, expected %s", sum, e.meta.SHA256)
+	}
+	return nil
+}
+
+// check verifies the contents of f against the checksum of e, removing e
+// if they don't match. It returns whether they did. c.mu must not be held,
+// since hashing a large archive takes a while.
+func (c *ArtifactCache) check(e *artifactCacheEntry, f *os.File) bool {
+	err := e.verify(f)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.errors.logf("Artifact cache: removing corrupt %s: %v\n", e.path, err)
+		// Unless it was removed or replaced in the meantime
+		if c.entries[e.path] == e {
+			c.remove(e)
+		}
+		return false
+	}
+	e.verified = true
+	return true
+}
+
+// verifyAll checks the entries which weren't checked yet, so that corrupt ones
+// are found soon after startup rather than when they are used.
+func (c *ArtifactCache) verifyAll() {
+	c.mu.Lock()
+	var entries []*artifactCacheEntry
+	for _, e := range c.entries {
+		if !e.verified {
+			entries = append(entries, e)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, e := range entries {
+		c.mu.Lock()
+		done := e.verified || c.entries[e.path] != e
+		c.mu.Unlock()
+		if done {
+			continue
+		}
+
+		// If it can't be opened, Get will deal with it
+		f, err := os.Open(filepath.Join(c.dir, e.path))
+		if err != nil {
+			continue
+		}
+		c.check(e, f)
+		f.Close()
+	}
+	c.debug.Printf("Checked %d entries\n", len(entries))
+}
+
+// Get returns the cached archive for key, opened for reading, or nil if it
+// is not cached.
+func (c *ArtifactCache) Get(key ArtifactCacheKey) *os.File {
+	c.mu.Lock()
+	e, ok := c.entries[key.path()]
+	if !ok {
+		c.debug.Printf("Miss: %s\n", key.path())
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+
+	path := filepath.Join(c.dir, e.path)
+	f, err := os.Open(path)
+	if err != nil {
+		c.errors.logf("Artifact cache: %v\n", err)
+		c.remove(e)
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+	verified := e.verified
+	c.mu.Unlock()
+
+	// Check the contents the first time they are used, unless that was
+	// already done in the background
+	if !verified && !c.check(e, f) {
+		f.Close()
+		c.mu.Lock()
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.debug.Printf("Hit: %s\n", key.path())
+	c.hits++
+	e.lastAccess = time.Now()
+	os.Chtimes(path, e.lastAccess, e.lastAccess)
+	return f
+}
+
+// Put stores the archive written by fill under key, and returns it opened for
+// reading. If the archive doesn't fit in the cache, it is still returned, but
+// not kept.
+func (c *ArtifactCache) Put(key ArtifactCacheKey, fill func(w io.Writer) error) (*os.File, error) {
+	rel := key.path()
+	path := filepath.Join(c.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Download to a temporary file first, so an interrupted download never
+	// looks like a complete entry
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if err := fill(io.MultiWriter(f, h)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	meta := artifactCacheMeta{
+		Size:   fi.Size(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}
+	metaBuf, _ := json.Marshal(&meta)
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if meta.Size > c.maxSize {
+		// Too big to keep; the open file stays usable after removal
+		c.debug.Printf("Not caching %s (%d bytes)\n", rel, meta.Size)
+		os.Remove(f.Name())
+		return f, nil
+	}
+
+	if old, ok := c.entries[rel]; ok {
+		c.remove(old)
+	}
+
+	// The data is moved into place before the metadata is written, so a
+	// crash in between leaves an entry that is discarded on startup
+	if err := os.Rename(f.Name(), path); err != nil {
+		c.errors.logf("Artifact cache: %v\n", err)
+		os.Remove(f.Name())
+		return f, nil
+	}
+	if err := ioutil.WriteFile(path+".meta", metaBuf, 0600); err != nil {
+		c.errors.logf("Artifact cache: %v\n", err)
+		os.Remove(path)
+		return f, nil
+	}
+
+	c.debug.Printf("Stored %s (%d bytes)\n", rel, meta.Size)
+	c.entries[rel] = &artifactCacheEntry{
+		path:       rel,
+		meta:       meta,
+		lastAccess: time.Now(),
+		verified:   true,
+	}
+	c.size += meta.Size
+	c.evict(rel)
+
+	return f, nil
+}
+
+// Flush removes the archives of the GitLab instance at host.
+func (c *ArtifactCache) Flush(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := url.PathEscape(host) + string(filepath.Separator)
+	for path, e := range c.entries {
+		if strings.HasPrefix(path, prefix) {
+			c.remove(e)
+		}
+	}
+}
+
+// String returns the cache's statistics in a readable form.
+func (c *ArtifactCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Sprintf("artifact_cache_hits: %d\n"+
+		"artifact_cache_misses: %d\n"+
+		"artifact_cache_entries: %d\n"+
+		"artifact_cache_bytes: %d\n",
+		c.hits, c.misses, len(c.entries), c.size)
+}
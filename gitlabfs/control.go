@@ -0,0 +1,526 @@
+package gitlabfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Each instance has a hidden directory about the filesystem itself:
+ * .gitlabfs/
+ *     errors       The latest errors, oldest first, one per line
+ *     stats        Counts of API requests, bytes downloaded, artifact cache
+ *                  hits and misses, and the latency of each API endpoint
+ *     version      The versions of gitlab-fuse and Go
+ *     config       The options in effect, in the config file format
+ *     ctl          Write-only; runs the commands written to it, one per line:
+ *                  refresh <path>  Fetch everything at or below path (in
+ *                                  the directory holding .gitlabfs) again
+ *                                  the next time it is accessed, including
+ *                                  all jobs of jobs/ directories
+ *                  flush-cache     Refresh everything, and remove the
+ *                                  instance's cached artifact archives
+ *                  debug on|off    Enable or disable debug logging
+ *
+ * When several instances are mounted, the root of the mount holds one too,
+ * covering all of them (see MultiFs.addControlDir).
+ *
+ * Directories which are only updated every so often (jobs/ and pipelines/)
+ * also hold a .refresh file, which refreshes the directory when touched.
+ */
+
+// The number of lines kept in .gitlabfs/errors
+const maxErrorLogLines = 1000
+
+// addControlDir adds the .gitlabfs directory to the root.
+func (fs *GitlabFs) addControlDir() {
+	if fs.root.Inode().GetChild(".gitlabfs") != nil {
+		return
+	}
+
+	dir := fs.root.Inode().NewChild(".gitlabfs", true, NewDirNode(&fs.started))
+	dir.NewChild("errors", false, &errorLogNode{
+		Node: nodefs.NewDefaultNode(),
+		data: fs.errorData,
+	})
+	dir.NewChild("stats", false, &generatedFileNode{
+		Node:     nodefs.NewDefaultNode(),
+		generate: fs.statsText,
+	})
+	dir.NewChild("version", false, NewStaticFileNode(versionText(), fs.started.get()))
+	dir.NewChild("config", false, &generatedFileNode{
+		Node:     nodefs.NewDefaultNode(),
+		generate: fs.configText,
+	})
+	dir.NewChild("ctl", false, &controlCtlNode{
+		Node:  nodefs.NewDefaultNode(),
+		run:   fs.runCommand,
+		mtime: &fs.started,
+	})
+}
+
+// errorf logs an error, and keeps it in .gitlabfs/errors.
+func (fs *GitlabFs) errorf(format string, args ...interface{}) {
+	fs.errors.logf(format, args...)
+}
+
+/******************************************************************************/
+/* errors */
+
+// errorLog holds the latest errors of an instance.
+type errorLog struct {
+	mu    sync.Mutex
+	lines []string
+	mtime time.Time
+}
+
+// logf logs an error, and keeps it.
+func (l *errorLog) logf(format string, args ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	log.Println(msg)
+	l.add(time.Now(), msg)
+}
+
+func (l *errorLog) add(t time.Time, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A multi-line message would look like several errors
+	msg = strings.ReplaceAll(msg, "\n", " ")
+	l.lines = append(l.lines, t.Format(time.RFC3339)+" "+msg+"\n")
+	if len(l.lines) > maxErrorLogLines {
+		l.lines = l.lines[len(l.lines)-maxErrorLogLines:]
+	}
+	l.mtime = t
+}
+
+// get returns the lines of the log, and the time of the latest one.
+func (l *errorLog) get() ([]string, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...), l.mtime
+}
+
+// sortErrorLines sorts the lines of several errorLogs by their times, and
+// returns the latest maxErrorLogLines of them.
+func sortErrorLines(lines []string) []string {
+	// The times are all formatted alike, so they sort as strings
+	sort.SliceStable(lines, func(i, j int) bool {
+		ti, _ := splitErrorLine(lines[i])
+		tj, _ := splitErrorLine(lines[j])
+		return ti < tj
+	})
+	if len(lines) > maxErrorLogLines {
+		lines = lines[len(lines)-maxErrorLogLines:]
+	}
+	return lines
+}
+
+// splitErrorLine splits a line of an errorLog into the time and the message.
+func splitErrorLine(line string) (string, string) {
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return "", line
+}
+
+// errorData returns the latest errors of the instance, and of its artifact
+// cache, oldest first.
+func (fs *GitlabFs) errorData() ([]byte, time.Time) {
+	lines, mtime := fs.errors.get()
+	if cache := fs.opts.ArtifactCache; cache != nil {
+		cacheLines, t := cache.errors.get()
+		lines = sortErrorLines(append(lines, cacheLines...))
+		if t.After(mtime) {
+			mtime = t
+		}
+	}
+	return []byte(strings.Join(lines, "")), mtime
+}
+
+// errorLogNode is .gitlabfs/errors, whose contents and time are returned by
+// data.
+type errorLogNode struct {
+	nodefs.Node
+	data func() ([]byte, time.Time)
+}
+
+func (n *errorLogNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	data, mtime := n.data()
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(data))
+	setTimes(out, mtime)
+	return fuse.OK
+}
+
+func (n *errorLogNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	data, _ := n.data()
+	return newVolatileDataFile(data), fuse.OK
+}
+
+/******************************************************************************/
+/* stats, version, config */
+
+// generatedFileNode is a read-only file whose contents are generated anew
+// whenever it is looked at.
+type generatedFileNode struct {
+	nodefs.Node
+	generate func() string
+}
+
+func (n *generatedFileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.generate()))
+	setTimes(out, time.Now())
+	return fuse.OK
+}
+
+func (n *generatedFileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	return newVolatileDataFile([]byte(n.generate())), fuse.OK
+}
+
+func (fs *GitlabFs) statsText() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "uptime: %v\n", time.Since(fs.started.get()).Round(time.Second))
+	if cache := fs.opts.ArtifactCache; cache != nil {
+		// Shared by the instances using the same cache
+		b.WriteString(cache.String())
+	}
+	if stats := fs.opts.Stats; stats != nil {
+		b.WriteString(stats.String())
+	}
+	return b.String()
+}
+
+func versionText() string {
+	return fmt.Sprintf("gitlab-fuse %s\n%s %s/%s\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// configText returns the options in effect, in the format of the config file.
+// The token is redacted.
+func (fs *GitlabFs) configText() string {
+	opts := fs.opts
+
+	var b strings.Builder
+	set := func(key string, value interface{}) {
+		switch v := value.(type) {
+		case string:
+			value = strconv.Quote(v)
+		case time.Duration:
+			value = strconv.Quote(v.String())
+		case []string:
+			quoted := make([]string, len(v))
+			for i, s := range v {
+				quoted[i] = strconv.Quote(s)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		}
+		fmt.Fprintf(&b, "%s = %v\n", key, value)
+	}
+
+	set("url", strings.TrimSuffix(fs.client.BaseURL().String(), "api/v4/"))
+	set("token", "(redacted)")
+	set("debug", atomic.LoadInt32(&fs.debugging) != 0)
+
+	set("min_namespace_dir_update_delay", opts.MinNamespaceDirUpdateDelay)
+	set("min_jobs_dir_update_delay", opts.MinJobsDirUpdateDelay)
+	set("min_refs_dir_update_delay", opts.MinRefsDirUpdateDelay)
+	set("min_trace_update_delay", opts.MinTraceUpdateDelay)
+	set("min_pipelines_dir_update_delay", opts.MinPipelinesDirUpdateDelay)
+	set("min_merge_requests_dir_update_delay", opts.MinMergeRequestsDirUpdateDelay)
+	set("min_issues_dir_update_delay", opts.MinIssuesDirUpdateDelay)
+
+	if opts.MaxAttempts != 0 {
+		set("max_attempts", opts.MaxAttempts)
+	}
+	if opts.RequestsPerSecond != 0 {
+		set("requests_per_second", opts.RequestsPerSecond)
+	}
+
+	if cache := opts.ArtifactCache; cache != nil {
+		set("artifact_cache_dir", cache.dir)
+		set("artifact_cache_size", strconv.FormatInt(cache.maxSize, 10))
+	}
+
+	set("groups", opts.Groups)
+	set("membership", opts.Membership)
+	set("owned", opts.Owned)
+	set("starred", opts.Starred)
+	switch {
+	case opts.Archived == nil:
+		set("archived", "include")
+	case *opts.Archived:
+		set("archived", "only")
+	default:
+		set("archived", "exclude")
+	}
+	if opts.MinAccessLevel != 0 {
+		set("min_access_level", accessLevelName(opts.MinAccessLevel))
+	}
+	set("include_projects", opts.IncludeProjects)
+	set("exclude_projects", opts.ExcludeProjects)
+
+	subtrees := opts.Subtrees
+	if len(subtrees) == 0 {
+		subtrees = AllSubtrees
+	}
+	set("subtrees", subtrees)
+
+	return b.String()
+}
+
+func accessLevelName(level gitlab.AccessLevelValue) string {
+	switch level {
+	case gitlab.GuestPermissions:
+		return "guest"
+	case gitlab.ReporterPermissions:
+		return "reporter"
+	case gitlab.DeveloperPermissions:
+		return "developer"
+	case gitlab.MaintainerPermissions:
+		return "maintainer"
+	case gitlab.OwnerPermissions:
+		return "owner"
+	}
+	return strconv.Itoa(int(level))
+}
+
+/******************************************************************************/
+/* ctl */
+
+// controlCtlNode is a write-only file which runs the commands written to it
+// using run. It has the time the filesystem was mounted.
+type controlCtlNode struct {
+	nodefs.Node
+	run   func(line string) fuse.Status
+	mtime *sharedTime
+}
+
+func (n *controlCtlNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0200
+	setTimes(out, n.mtime.get())
+	return fuse.OK
+}
+
+func (n *controlCtlNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE == 0 {
+		return nil, fuse.EPERM
+	}
+	return &controlCtlFile{
+		File: nodefs.NewDefaultFile(),
+		run:  n.run,
+	}, fuse.OK
+}
+
+// Truncate accepts the truncation done by e.g. "echo flush-cache > ctl".
+func (n *controlCtlNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
+type controlCtlFile struct {
+	nodefs.File
+	run func(line string) fuse.Status
+}
+
+func (f *controlCtlFile) String() string {
+	return "controlCtlFile"
+}
+
+// Write runs each command (one per line) in data, stopping at the first one
+// which fails.
+func (f *controlCtlFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if status := f.run(line); !status.Ok() {
+			return 0, status
+		}
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *controlCtlFile) Truncate(size uint64) fuse.Status {
+	return fuse.OK
+}
+
+// splitCommand splits a line written to .gitlabfs/ctl into the command and
+// its argument, which is the rest of the line, since paths may contain spaces.
+func splitCommand(line string) (cmd, arg string) {
+	cmd = strings.TrimSpace(line)
+	if i := strings.IndexAny(cmd, " \t"); i >= 0 {
+		cmd, arg = cmd[:i], strings.TrimSpace(cmd[i:])
+	}
+	return cmd, arg
+}
+
+// runCommand runs a single command written to .gitlabfs/ctl.
+func (fs *GitlabFs) runCommand(line string) fuse.Status {
+	cmd, arg := splitCommand(line)
+
+	switch {
+	case cmd == "refresh" && arg != "":
+		inode := fs.findInode(arg)
+		if inode == nil {
+			fs.errorf("ctl: refresh: %q not found\n", arg)
+			return fuse.ENOENT
+		}
+		fs.info.Printf("Refreshing %q\n", arg)
+		fs.refresh(inode, true)
+
+	case cmd == "flush-cache" && arg == "":
+		fs.info.Println("Flushing caches")
+		fs.refresh(fs.root.Inode(), true)
+		if cache := fs.opts.ArtifactCache; cache != nil {
+			cache.Flush(fs.client.BaseURL().Host)
+		}
+
+	case cmd == "debug" && (arg == "on" || arg == "off"):
+		if arg == "on" {
+			fs.SetDebugLogOutput(os.Stderr)
+		} else {
+			fs.SetDebugLogOutput(ioutil.Discard)
+		}
+		fs.info.Printf("Debug logging %s\n", arg)
+
+	default:
+		fs.errorf("ctl: invalid command %q\n", strings.TrimSpace(line))
+		return fuse.EINVAL
+	}
+	return fuse.OK
+}
+
+// findInode returns the inode at p (relative to the root), or nil if it isn't
+// known. Nothing is looked up.
+func (fs *GitlabFs) findInode(p string) *nodefs.Inode {
+	inode := fs.root.Inode()
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if inode = inode.GetChild(name); inode == nil {
+			return nil
+		}
+	}
+	return inode
+}
+
+/*****/
+
+// expirable is a node which keeps what it fetched from GitLab for a while.
+type expirable interface {
+	// expire makes the next access fetch it again, however recently it was
+	// fetched.
+	expire()
+}
+
+// resyncable is a node whose updates only fetch what changed since the last
+// one, e.g. a jobs/ directory only lists the new jobs.
+type resyncable interface {
+	// resync makes the next access fetch everything again.
+	resync()
+}
+
+// refresh expires inode and everything below it, and tells the kernel to drop
+// what it cached about them. If resync is true, the nodes which only fetch
+// what changed fetch everything again.
+func (fs *GitlabFs) refresh(inode *nodefs.Inode, resync bool) {
+	expired := fs.expire(inode, resync, nil)
+	if fs.conn == nil || len(expired) == 0 {
+		return
+	}
+
+	// As in removeChild, the kernel may be waiting for us. A single
+	// goroutine sends the notifications one after the other, however many
+	// there are.
+	go func() {
+		for _, inode := range expired {
+			fs.conn.FileNotify(inode, 0, 0)
+		}
+	}()
+}
+
+// expire expires inode and everything below it, and returns the inodes which
+// were expired, appended to expired.
+func (fs *GitlabFs) expire(inode *nodefs.Inode, resync bool, expired []*nodefs.Inode) []*nodefs.Inode {
+	if n, ok := inode.Node().(resyncable); ok && resync {
+		n.resync()
+	}
+	if n, ok := inode.Node().(expirable); ok {
+		n.expire()
+		expired = append(expired, inode)
+	}
+	for _, ch := range inode.Children() {
+		expired = fs.expire(ch, resync, expired)
+	}
+	return expired
+}
+
+/******************************************************************************/
+/* .refresh */
+
+// refreshFileNode is an empty file which refreshes the directory holding it
+// when it is touched or written to, e.g. to see a job that was just started
+// without waiting for the next update. It keeps the time the filesystem was
+// mounted, since touching it doesn't change it.
+type refreshFileNode struct {
+	nodefs.Node
+	fs *GitlabFs
+}
+
+func NewRefreshFileNode(fs *GitlabFs) *refreshFileNode {
+	return &refreshFileNode{
+		Node: nodefs.NewDefaultNode(),
+		fs:   fs,
+	}
+}
+
+func (n *refreshFileNode) refreshParent() {
+	if parent, _ := n.Inode().Parent(); parent != nil {
+		n.fs.debug.Printf("Refreshing via .refresh\n")
+		n.fs.refresh(parent, false)
+	}
+}
+
+func (n *refreshFileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0644
+	setTimes(out, n.fs.started.get())
+	return fuse.OK
+}
+
+func (n *refreshFileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		n.refreshParent()
+	}
+	return nodefs.NewDevNullFile(), fuse.OK
+}
+
+// Utimens refreshes on "touch .refresh".
+func (n *refreshFileNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	n.refreshParent()
+	return fuse.OK
+}
+
+func (n *refreshFileNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
@@ -1,17 +1,28 @@
 package gitlabfs
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/xanzy/go-gitlab"
 )
 
 type GitlabClient struct {
 	*gitlab.Client
 	debug *log.Logger
+
+	// Merges identical requests made concurrently
+	requests requestGroup
 }
 
 func NewGitlabClient(client *gitlab.Client) *GitlabClient {
@@ -25,28 +36,541 @@ func (git *GitlabClient) SetDebugLogOutput(w io.Writer) {
 	git.debug.SetOutput(w)
 }
 
-// GetAllVisibleProjects returns a map of namespace to a list of Projects in that namespace.
-func (git *GitlabClient) getAllVisibleProjects() (map[string][]*gitlab.Project, error) {
+// requestKey identifies a request for merging in-flight duplicates.
+func requestKey(name string, args ...interface{}) string {
+	return fmt.Sprintf("%s%v", name, args)
+}
+
+// GetProject returns a single project, by ID or full path.
+func (git *GitlabClient) GetProject(pid interface{}) (*gitlab.Project, error) {
+	v, err := git.requests.Do(requestKey("GetProject", pid), func() (interface{}, error) {
+		prj, _, err := git.Projects.GetProject(pid, nil)
+		return prj, err
+	})
+	prj, _ := v.(*gitlab.Project)
+	return prj, err
+}
+
+// GetNamespace returns a single namespace, by ID or full path. The namespaces
+// API only has the groups the user is a member of, so other groups are looked
+// up using the groups API.
+func (git *GitlabClient) GetNamespace(id interface{}) (*gitlab.Namespace, error) {
+	v, err := git.requests.Do(requestKey("GetNamespace", id), func() (interface{}, error) {
+		ns, _, err := git.Namespaces.GetNamespace(id)
+		if err == nil || !(isNotFound(err) || apiStatusCode(err) == http.StatusForbidden) {
+			return ns, err
+		}
+
+		group, _, err := git.Groups.GetGroup(id, &gitlab.GetGroupOptions{
+			WithProjects: gitlab.Bool(false),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &gitlab.Namespace{
+			ID:       group.ID,
+			Name:     group.Name,
+			Path:     group.Path,
+			Kind:     "group",
+			FullPath: group.FullPath,
+			ParentID: group.ParentID,
+			WebURL:   group.WebURL,
+		}, nil
+	})
+	ns, _ := v.(*gitlab.Namespace)
+	return ns, err
+}
+
+// GetJob returns a single job.
+func (git *GitlabClient) GetJob(pid, jobID int) (*Job, error) {
+	v, err := git.requests.Do(requestKey("GetJob", pid, jobID), func() (interface{}, error) {
+		u := fmt.Sprintf("projects/%d/jobs/%d", pid, jobID)
+
+		req, err := git.NewRequest(http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		job := new(Job)
+		if _, err := git.Do(req, job); err != nil {
+			return nil, err
+		}
+		return job, nil
+	})
+	job, _ := v.(*Job)
+	return job, err
+}
+
+// GetPipeline returns a single pipeline.
+func (git *GitlabClient) GetPipeline(pid, pipelineID int) (*gitlab.Pipeline, error) {
+	v, err := git.requests.Do(requestKey("GetPipeline", pid, pipelineID), func() (interface{}, error) {
+		p, _, err := git.Pipelines.GetPipeline(pid, pipelineID)
+		return p, err
+	})
+	p, _ := v.(*gitlab.Pipeline)
+	return p, err
+}
+
+// GetMergeRequest returns a single merge request.
+func (git *GitlabClient) GetMergeRequest(pid, iid int) (*gitlab.MergeRequest, error) {
+	v, err := git.requests.Do(requestKey("GetMergeRequest", pid, iid), func() (interface{}, error) {
+		mr, _, err := git.MergeRequests.GetMergeRequest(pid, iid, nil)
+		return mr, err
+	})
+	mr, _ := v.(*gitlab.MergeRequest)
+	return mr, err
+}
+
+// addProjects adds projects to a map of namespace full path (e.g.
+// "group/subgroup") to a list of Projects in that namespace.
+func addProjects(result map[string][]*gitlab.Project, projects []*gitlab.Project) {
+	for _, p := range projects {
+		namespace := p.Namespace.FullPath
+		result[namespace] = append(result[namespace], p)
+	}
+}
+
+func (git *GitlabClient) getAllProjects(opt gitlab.ListProjectsOptions) (map[string][]*gitlab.Project, error) {
 	result := make(map[string][]*gitlab.Project)
 
-	opt := gitlab.ListProjectsOptions{
+	opt.ListOptions = gitlab.ListOptions{
+		Page:    1,
+		PerPage: 100,
+	}
+
+	for {
+		prj, resp, err := git.Projects.ListProjects(&opt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Store these projects in the map
+		addProjects(result, prj)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// GetAllProjects returns a map of namespace full path (e.g.
+// "group/subgroup") to a list of Projects in that namespace, for all
+// projects passing the filters in opt.
+func (git *GitlabClient) GetAllProjects(opt gitlab.ListProjectsOptions) (map[string][]*gitlab.Project, error) {
+	t0 := time.Now()
+	result, err := git.getAllProjects(opt)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllProjects() => %d namespaces in %v\n", len(result), dt)
+	return result, err
+}
+
+// IsProjectListed returns true if the project with the given ID passes the
+// filters in opt, i.e. it would be returned by GetAllProjects(opt).
+func (git *GitlabClient) IsProjectListed(pid int, opt gitlab.ListProjectsOptions) (bool, error) {
+	opt.IDAfter = gitlab.Int(pid - 1)
+	opt.IDBefore = gitlab.Int(pid + 1)
+	opt.Simple = gitlab.Bool(true)
+
+	prj, _, err := git.Projects.ListProjects(&opt)
+	if err != nil {
+		return false, err
+	}
+	return len(prj) != 0, nil
+}
+
+func (git *GitlabClient) getAllGroupProjects(gid interface{}, opt gitlab.ListGroupProjectsOptions) (map[string][]*gitlab.Project, error) {
+	result := make(map[string][]*gitlab.Project)
+
+	opt.ListOptions = gitlab.ListOptions{
+		Page:    1,
+		PerPage: 100,
+	}
+
+	for {
+		prj, resp, err := git.Groups.ListGroupProjects(gid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Store these projects in the map
+		addProjects(result, prj)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// GetAllGroupProjects is like GetAllProjects, but only for the projects of a
+// group.
+func (git *GitlabClient) GetAllGroupProjects(gid interface{}, opt gitlab.ListGroupProjectsOptions) (map[string][]*gitlab.Project, error) {
+	t0 := time.Now()
+	result, err := git.getAllGroupProjects(gid, opt)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllGroupProjects(%v) => %d namespaces in %v\n", gid, len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllUserProjects(uid interface{}, opt gitlab.ListProjectsOptions) (map[string][]*gitlab.Project, error) {
+	result := make(map[string][]*gitlab.Project)
+
+	opt.ListOptions = gitlab.ListOptions{
+		Page:    1,
+		PerPage: 100,
+	}
+
+	for {
+		prj, resp, err := git.Projects.ListUserProjects(uid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Store these projects in the map
+		addProjects(result, prj)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// GetAllUserProjects is like GetAllProjects, but only for the projects in a
+// user's namespace.
+func (git *GitlabClient) GetAllUserProjects(uid interface{}, opt gitlab.ListProjectsOptions) (map[string][]*gitlab.Project, error) {
+	t0 := time.Now()
+	result, err := git.getAllUserProjects(uid, opt)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllUserProjects(%v) => %d namespaces in %v\n", uid, len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllTopLevelGroups() ([]*gitlab.Group, error) {
+	var result []*gitlab.Group
+
+	opt := &gitlab.ListGroupsOptions{
 		ListOptions: gitlab.ListOptions{
 			Page:    1,
 			PerPage: 100,
 		},
+		TopLevelOnly: gitlab.Bool(true),
 	}
 
 	for {
-		prj, resp, err := git.Projects.ListProjects(&opt)
+		groups, resp, err := git.Groups.ListGroups(opt)
 		if err != nil {
 			return nil, err
 		}
 
-		// Store these projects in the map
-		for _, p := range prj {
-			namespace := p.Namespace.Path
-			result[namespace] = append(result[namespace], p)
+		result = append(result, groups...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// GetAllTopLevelGroups returns all top-level groups visible to the user.
+func (git *GitlabClient) GetAllTopLevelGroups() ([]*gitlab.Group, error) {
+	t0 := time.Now()
+	result, err := git.getAllTopLevelGroups()
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllTopLevelGroups() => %d groups in %v\n", len(result), dt)
+	return result, err
+}
+
+// GetCurrentUser returns the user the client is authenticated as.
+func (git *GitlabClient) GetCurrentUser() (*gitlab.User, error) {
+	v, err := git.requests.Do(requestKey("GetCurrentUser"), func() (interface{}, error) {
+		user, _, err := git.Users.CurrentUser()
+		return user, err
+	})
+	user, _ := v.(*gitlab.User)
+	return user, err
+}
+
+// Job is a gitlab.Job, plus fields which go-gitlab does not decode.
+type Job struct {
+	gitlab.Job
+	FailureReason string     `json:"failure_reason"`
+	ErasedAt      *time.Time `json:"erased_at"`
+}
+
+// listProjectJobs returns a single page of a project's jobs, like
+// Jobs.ListProjectJobs.
+func (git *GitlabClient) listProjectJobs(pid interface{}, opt *gitlab.ListJobsOptions) ([]*Job, *gitlab.Response, error) {
+	u := fmt.Sprintf("projects/%s/jobs", url.PathEscape(fmt.Sprint(pid)))
+
+	req, err := git.NewRequest(http.MethodGet, u, opt, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var jobs []*Job
+	resp, err := git.Do(req, &jobs)
+	if err != nil {
+		return nil, resp, err
+	}
+	return jobs, resp, nil
+}
+
+// getNewProjectJobs returns the project's jobs newer than sinceID. Jobs are
+// listed newest first, so no more pages are requested once sinceID is reached.
+func (git *GitlabClient) getNewProjectJobs(pid interface{}, sinceID int) ([]*Job, error) {
+	result := make([]*Job, 0)
+
+	opt := gitlab.ListJobsOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		jobs, resp, err := git.listProjectJobs(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		done := false
+		for _, job := range jobs {
+			if job.ID <= sinceID {
+				done = true
+				continue
+			}
+			result = append(result, job)
+		}
+
+		// Go to the next page
+		if done || resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetNewProjectJobs(pid interface{}, sinceID int) ([]*Job, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetNewProjectJobs", pid, sinceID), func() (interface{}, error) {
+		return git.getNewProjectJobs(pid, sinceID)
+	})
+	result, _ := v.([]*Job)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetNewProjectJobs(%d) => %d records in %v\n", sinceID, len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllBranches(pid interface{}) ([]*gitlab.Branch, error) {
+	result := make([]*gitlab.Branch, 0)
+
+	opt := gitlab.ListBranchesOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		branches, resp, err := git.Branches.ListBranches(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, branches...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllBranches(pid interface{}) ([]*gitlab.Branch, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllBranches", pid), func() (interface{}, error) {
+		return git.getAllBranches(pid)
+	})
+	result, _ := v.([]*gitlab.Branch)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllBranches() => %d records in %v\n", len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllTags(pid interface{}) ([]*gitlab.Tag, error) {
+	result := make([]*gitlab.Tag, 0)
+
+	opt := gitlab.ListTagsOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		tags, resp, err := git.Tags.ListTags(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, tags...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllTags(pid interface{}) ([]*gitlab.Tag, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllTags", pid), func() (interface{}, error) {
+		return git.getAllTags(pid)
+	})
+	result, _ := v.([]*gitlab.Tag)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllTags() => %d records in %v\n", len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getRepositoryTree(pid interface{}, path, ref string) ([]*gitlab.TreeNode, error) {
+	result := make([]*gitlab.TreeNode, 0)
+
+	opt := gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+		Ref: gitlab.String(ref),
+	}
+	if path != "" {
+		opt.Path = gitlab.String(path)
+	}
+
+	for {
+		nodes, resp, err := git.Repositories.ListTree(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, nodes...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// GetRepositoryTree returns the (non-recursive) contents of the directory at
+// path in the repository tree at ref.
+func (git *GitlabClient) GetRepositoryTree(pid interface{}, path, ref string) ([]*gitlab.TreeNode, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetRepositoryTree", pid, path, ref), func() (interface{}, error) {
+		return git.getRepositoryTree(pid, path, ref)
+	})
+	result, _ := v.([]*gitlab.TreeNode)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetRepositoryTree(%q, %q) => %d records in %v\n", path, ref, len(result), dt)
+	return result, err
+}
+
+// withRange returns a RequestOptionFunc which requests only the content from
+// start up to and including end. If end is negative, everything from start
+// onwards is requested.
+func withRange(start, end int64) gitlab.RequestOptionFunc {
+	return func(req *retryablehttp.Request) error {
+		if end < 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		}
+		return nil
+	}
+}
+
+// GetTraceFrom returns the portion of a job's trace starting at offset. If
+// the server ignores the Range request, the leading part of the full trace is
+// discarded here instead.
+func (git *GitlabClient) GetTraceFrom(pid interface{}, jobID int, offset int64) ([]byte, error) {
+	t0 := time.Now()
+	r, resp, err := git.Jobs.GetTraceFile(pid, jobID, withRange(offset, -1))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Nothing new since offset
+			return nil, nil
 		}
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if int64(len(buf)) <= offset {
+			buf = nil
+		} else {
+			buf = buf[offset:]
+		}
+	}
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetTraceFrom(%d, %d) => %d bytes in %v\n", jobID, offset, len(buf), dt)
+	return buf, nil
+}
+
+func (git *GitlabClient) getAllProjectPipelines(pid interface{}) ([]*gitlab.PipelineInfo, error) {
+	result := make([]*gitlab.PipelineInfo, 0)
+
+	opt := gitlab.ListProjectPipelinesOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		pipelines, resp, err := git.Pipelines.ListProjectPipelines(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, pipelines...)
 
 		// Go to the next page
 		if resp.NextPage == 0 {
@@ -58,16 +582,19 @@ func (git *GitlabClient) getAllVisibleProjects() (map[string][]*gitlab.Project,
 	return result, nil
 }
 
-func (git *GitlabClient) GetAllVisibleProjects() (map[string][]*gitlab.Project, error) {
+func (git *GitlabClient) GetAllProjectPipelines(pid interface{}) ([]*gitlab.PipelineInfo, error) {
 	t0 := time.Now()
-	result, err := git.getAllVisibleProjects()
+	v, err := git.requests.Do(requestKey("GetAllProjectPipelines", pid), func() (interface{}, error) {
+		return git.getAllProjectPipelines(pid)
+	})
+	result, _ := v.([]*gitlab.PipelineInfo)
 	dt := time.Now().Sub(t0)
 
-	git.debug.Printf("GetAllVisibleProjects() => %d records in %v\n", len(result), dt)
+	git.debug.Printf("GetAllProjectPipelines() => %d records in %v\n", len(result), dt)
 	return result, err
 }
 
-func (git *GitlabClient) getAllProjectJobs(pid interface{}) ([]*gitlab.Job, error) {
+func (git *GitlabClient) getAllPipelineJobs(pid interface{}, pipelineID int) ([]*gitlab.Job, error) {
 	result := make([]*gitlab.Job, 0)
 
 	opt := gitlab.ListJobsOptions{
@@ -78,7 +605,7 @@ func (git *GitlabClient) getAllProjectJobs(pid interface{}) ([]*gitlab.Job, erro
 	}
 
 	for {
-		jobs, resp, err := git.Jobs.ListProjectJobs(pid, &opt)
+		jobs, resp, err := git.Jobs.ListPipelineJobs(pid, pipelineID, &opt)
 		if err != nil {
 			return nil, err
 		}
@@ -95,11 +622,362 @@ func (git *GitlabClient) getAllProjectJobs(pid interface{}) ([]*gitlab.Job, erro
 	return result, nil
 }
 
-func (git *GitlabClient) GetAllProjectJobs(pid interface{}) ([]*gitlab.Job, error) {
+func (git *GitlabClient) GetAllPipelineJobs(pid interface{}, pipelineID int) ([]*gitlab.Job, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllPipelineJobs", pid, pipelineID), func() (interface{}, error) {
+		return git.getAllPipelineJobs(pid, pipelineID)
+	})
+	result, _ := v.([]*gitlab.Job)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllPipelineJobs(%d) => %d records in %v\n", pipelineID, len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllProjectMergeRequests(pid interface{}) ([]*gitlab.MergeRequest, error) {
+	result := make([]*gitlab.MergeRequest, 0)
+
+	opt := gitlab.ListProjectMergeRequestsOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		mrs, resp, err := git.MergeRequests.ListProjectMergeRequests(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, mrs...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllProjectMergeRequests(pid interface{}) ([]*gitlab.MergeRequest, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllProjectMergeRequests", pid), func() (interface{}, error) {
+		return git.getAllProjectMergeRequests(pid)
+	})
+	result, _ := v.([]*gitlab.MergeRequest)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllProjectMergeRequests() => %d records in %v\n", len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllMergeRequestDiscussions(pid interface{}, iid int) ([]*gitlab.Discussion, error) {
+	result := make([]*gitlab.Discussion, 0)
+
+	opt := gitlab.ListMergeRequestDiscussionsOptions{
+		Page:    1,
+		PerPage: 100,
+	}
+
+	for {
+		discussions, resp, err := git.Discussions.ListMergeRequestDiscussions(pid, iid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, discussions...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllMergeRequestDiscussions(pid interface{}, iid int) ([]*gitlab.Discussion, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllMergeRequestDiscussions", pid, iid), func() (interface{}, error) {
+		return git.getAllMergeRequestDiscussions(pid, iid)
+	})
+	result, _ := v.([]*gitlab.Discussion)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllMergeRequestDiscussions(%d) => %d records in %v\n", iid, len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllProjectIssues(pid interface{}) ([]*gitlab.Issue, error) {
+	result := make([]*gitlab.Issue, 0)
+
+	opt := gitlab.ListProjectIssuesOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		issues, resp, err := git.Issues.ListProjectIssues(pid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, issues...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllProjectIssues(pid interface{}) ([]*gitlab.Issue, error) {
+	t0 := time.Now()
+	v, err := git.requests.Do(requestKey("GetAllProjectIssues", pid), func() (interface{}, error) {
+		return git.getAllProjectIssues(pid)
+	})
+	result, _ := v.([]*gitlab.Issue)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetAllProjectIssues() => %d records in %v\n", len(result), dt)
+	return result, err
+}
+
+func (git *GitlabClient) getAllIssueNotes(pid interface{}, iid int) ([]*gitlab.Note, error) {
+	result := make([]*gitlab.Note, 0)
+
+	opt := gitlab.ListIssueNotesOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+	}
+
+	for {
+		notes, resp, err := git.Notes.ListIssueNotes(pid, iid, &opt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, notes...)
+
+		// Go to the next page
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+func (git *GitlabClient) GetAllIssueNotes(pid interface{}, iid int) ([]*gitlab.Note, error) {
 	t0 := time.Now()
-	result, err := git.getAllProjectJobs(pid)
+	v, err := git.requests.Do(requestKey("GetAllIssueNotes", pid, iid), func() (interface{}, error) {
+		return git.getAllIssueNotes(pid, iid)
+	})
+	result, _ := v.([]*gitlab.Note)
 	dt := time.Now().Sub(t0)
 
-	git.debug.Printf("GetAllProjectsJobs() => %d records in %v\n", len(result), dt)
+	git.debug.Printf("GetAllIssueNotes(%d) => %d records in %v\n", iid, len(result), dt)
 	return result, err
 }
+
+// apiStatusCode returns the HTTP status code of an error response from the
+// API, or 0 if err is not one.
+func apiStatusCode(err error) int {
+	var errResp *gitlab.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.StatusCode
+	}
+	return 0
+}
+
+// isNotFound returns true if err is a "404 Not Found" response from the API.
+func isNotFound(err error) bool {
+	return apiStatusCode(err) == http.StatusNotFound
+}
+
+// IsAuthError returns true if err is a response from the API rejecting the
+// credentials, or the access they grant.
+func IsAuthError(err error) bool {
+	code := apiStatusCode(err)
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// ErrRangeNotSupported is returned when the server answers a range request
+// with something other than the requested range.
+var ErrRangeNotSupported = errors.New("Server does not support range requests")
+
+// limitedWriter fails writes beyond its remaining capacity. It is used to
+// abort a response to a range request that turns out to be the whole
+// (potentially huge) resource.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, ErrRangeNotSupported
+	}
+	lw.remaining -= int64(len(p))
+	return lw.w.Write(p)
+}
+
+// GetArtifactsRange returns the bytes from start up to (but excluding) end of
+// a job's artifacts archive.
+func (git *GitlabClient) GetArtifactsRange(prjID, jobID int, start, end int64) ([]byte, error) {
+	t0 := time.Now()
+	u := fmt.Sprintf("projects/%d/jobs/%d/artifacts", prjID, jobID)
+
+	opts := []gitlab.RequestOptionFunc{withRange(start, end-1)}
+	req, err := git.NewRequest(http.MethodGet, u, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	resp, err := git.Do(req, &limitedWriter{w: &buf, remaining: end - start})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, ErrRangeNotSupported
+	}
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetArtifactsRange(%d, %d-%d) => %d bytes in %v\n", jobID, start, end, buf.Len(), dt)
+	return buf.Bytes(), nil
+}
+
+// GetSingleArtifactsFile returns the contents of a single file from a job's
+// artifacts archive, without downloading the whole archive.
+func (git *GitlabClient) GetSingleArtifactsFile(prjID, jobID int, path string) ([]byte, error) {
+	t0 := time.Now()
+
+	// The path is not escaped by go-gitlab
+	comps := strings.Split(path, "/")
+	for i, c := range comps {
+		comps[i] = url.PathEscape(c)
+	}
+
+	r, _, err := git.Jobs.DownloadSingleArtifactsFile(prjID, jobID, strings.Join(comps, "/"))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(r)
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("GetSingleArtifactsFile(%d, %q) => %d bytes in %v\n", jobID, path, len(buf), dt)
+	return buf, err
+}
+
+// artifactsBlockSize is the minimum amount of data fetched by each range
+// request made by ArtifactsReaderAt.
+const artifactsBlockSize = 64 * 1024
+
+// ArtifactsReaderAt reads parts of a job's artifacts archive on demand, using
+// HTTP range requests. This allows reading the table of contents of a zip
+// archive without downloading all of it.
+type ArtifactsReaderAt struct {
+	git   *GitlabClient
+	prjID int
+	jobID int
+	size  int64
+
+	// The most recently fetched block
+	mu       sync.Mutex
+	blockOff int64
+	block    []byte
+}
+
+func (git *GitlabClient) NewArtifactsReaderAt(prjID, jobID int, size int64) *ArtifactsReaderAt {
+	return &ArtifactsReaderAt{
+		git:   git,
+		prjID: prjID,
+		jobID: jobID,
+		size:  size,
+	}
+}
+
+func (r *ArtifactsReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		if pos < r.blockOff || pos >= r.blockOff+int64(len(r.block)) {
+			// Fetch an aligned block containing pos, big enough for the
+			// rest of the request
+			start := pos - pos%artifactsBlockSize
+			end := pos + int64(len(p)-n)
+			if end-start < artifactsBlockSize {
+				end = start + artifactsBlockSize
+			}
+			if end > r.size {
+				end = r.size
+			}
+
+			block, err := r.git.GetArtifactsRange(r.prjID, r.jobID, start, end)
+			if err != nil {
+				return n, err
+			}
+			if pos >= start+int64(len(block)) {
+				return n, io.ErrUnexpectedEOF
+			}
+			r.block, r.blockOff = block, start
+		}
+
+		n += copy(p[n:], r.block[pos-r.blockOff:])
+	}
+
+	return n, nil
+}
+
+// DownloadJobArtifacts writes a job's artifacts archive to w. Unlike
+// Jobs.GetJobArtifacts, the archive is not held in memory.
+func (git *GitlabClient) DownloadJobArtifacts(prjID, jobID int, w io.Writer) error {
+	t0 := time.Now()
+	u := fmt.Sprintf("projects/%d/jobs/%d/artifacts", prjID, jobID)
+
+	req, err := git.NewRequest(http.MethodGet, u, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := git.Do(req, cw); err != nil {
+		return err
+	}
+	dt := time.Now().Sub(t0)
+
+	git.debug.Printf("DownloadJobArtifacts(%d) => %d bytes in %v\n", jobID, cw.n, dt)
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -2,13 +2,23 @@ package gitlabfs
 
 import (
 	"archive/zip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -20,10 +30,21 @@ import (
 /**
  * Paths are composed like this:
  * <namespace>/
+ *    [<subgroup>/...]
  *    <project>/
+ *        description
+ *        repo/                 (see repo.go)
+ *        pipelines/            (see pipelines.go)
+ *        merge_requests/       (see mergerequests.go)
+ *        issues/               (see issues.go)
  *        jobs/
  *            <job_id>/
+ *                job.json      The whole job record
  *                status
+ *                name, stage, ref, commit, user, runner, duration,
+ *                created_at, started_at, finished_at, failure_reason,
+ *                web_url       Single values from the job record
+ *                ctl           Write "retry", "cancel", "play" or "erase"
  *                trace
  *                artifacts/
  *                    individual.bin
@@ -42,15 +63,219 @@ import (
 /* GitlabFs */
 
 type Options struct {
+	// The minimum amount of time between listings of the projects in a
+	// namespace (or the root)
+	MinNamespaceDirUpdateDelay time.Duration
+
 	// The minimum amount of time between updates to a project jobs/ directory
 	MinJobsDirUpdateDelay time.Duration
+
+	// The minimum amount of time between updates to a project
+	// repo/branches/ or repo/tags/ directory
+	MinRefsDirUpdateDelay time.Duration
+
+	// The minimum amount of time between fetches of new output for an open
+	// trace of a running job
+	MinTraceUpdateDelay time.Duration
+
+	// The minimum amount of time between updates to a project pipelines/
+	// directory, or to a pipeline's stages/ directory
+	MinPipelinesDirUpdateDelay time.Duration
+
+	// The minimum amount of time between updates to a project
+	// merge_requests/ directory, or to the contents of a merge request
+	MinMergeRequestsDirUpdateDelay time.Duration
+
+	// The minimum amount of time between updates to a project issues/
+	// directory, or to an issue's notes/ directory
+	MinIssuesDirUpdateDelay time.Duration
+
+	// If set, artifact archives of finished jobs are kept in this cache
+	ArtifactCache *ArtifactCache
+
+	// If set, the requests of the client are counted in these, for
+	// .gitlabfs/stats (see Stats.Transport)
+	Stats *Stats
+
+	// The settings of the client's RetryTransport and rate limiter, if any,
+	// for .gitlabfs/config
+	MaxAttempts       int
+	RequestsPerSecond float64
+
+	// If set, the client's RetryTransport, whose debug logging is enabled
+	// and disabled along with that of the filesystem
+	RetryTransport *RetryTransport
+
+	// If not empty, only projects in these groups (given by their full path,
+	// e.g. "group/subgroup") or their subgroups are shown
+	Groups []string
+
+	// Only show projects the user is a member of
+	Membership bool
+
+	// Only show projects owned by the user
+	Owned bool
+
+	// Only show projects starred by the user
+	Starred bool
+
+	// If set, only archived (true) or unarchived (false) projects are shown
+	Archived *bool
+
+	// If not zero, only projects where the user has at least this access
+	// level are shown
+	MinAccessLevel gitlab.AccessLevelValue
+
+	// If not empty, only projects whose full path (e.g. "group/project")
+	// matches one of these patterns (see path.Match) are shown. GitLab can't
+	// match patterns, so unlike the filters above this is done locally.
+	IncludeProjects []string
+
+	// Projects whose full path matches one of these patterns are not shown
+	ExcludeProjects []string
+
+	// If not empty, only these project subdirectories are shown (out of
+	// "repo", "issues", "merge_requests", "jobs" and "pipelines")
+	Subtrees []string
+}
+
+// AllSubtrees lists the project subdirectories which can be selected with
+// Options.Subtrees.
+var AllSubtrees = []string{"repo", "issues", "merge_requests", "jobs", "pipelines"}
+
+// projectListOptions returns the filters for listing projects, to be applied
+// by GitLab.
+func (opts *Options) projectListOptions() gitlab.ListProjectsOptions {
+	var opt gitlab.ListProjectsOptions
+	if opts.Membership {
+		opt.Membership = gitlab.Bool(true)
+	}
+	if opts.Owned {
+		opt.Owned = gitlab.Bool(true)
+	}
+	if opts.Starred {
+		opt.Starred = gitlab.Bool(true)
+	}
+	opt.Archived = opts.Archived
+	if opts.MinAccessLevel != 0 {
+		opt.MinAccessLevel = gitlab.AccessLevel(opts.MinAccessLevel)
+	}
+	return opt
+}
+
+// groupProjectListOptions is like projectListOptions, for listing the
+// projects of a group.
+func (opts *Options) groupProjectListOptions() gitlab.ListGroupProjectsOptions {
+	opt := gitlab.ListGroupProjectsOptions{
+		IncludeSubGroups: gitlab.Bool(true),
+		WithShared:       gitlab.Bool(false),
+	}
+	if opts.Owned {
+		opt.Owned = gitlab.Bool(true)
+	}
+	if opts.Starred {
+		opt.Starred = gitlab.Bool(true)
+	}
+	opt.Archived = opts.Archived
+
+	// Group projects can't be filtered by membership, but any access level
+	// implies it
+	minAccessLevel := opts.MinAccessLevel
+	if opts.Membership && minAccessLevel == 0 {
+		minAccessLevel = gitlab.GuestPermissions
+	}
+	if minAccessLevel != 0 {
+		opt.MinAccessLevel = gitlab.AccessLevel(minAccessLevel)
+	}
+	return opt
+}
+
+// filtersProjects returns true if any of the filters applied by GitLab are
+// set (except Groups).
+func (opts *Options) filtersProjects() bool {
+	return opts.Membership || opts.Owned || opts.Starred || opts.Archived != nil || opts.MinAccessLevel != 0
+}
+
+// inGroups returns true if the namespace with the given full path is one of
+// the Groups, or a subgroup of one.
+func (opts *Options) inGroups(fullPath string) bool {
+	for _, group := range opts.Groups {
+		if fullPath == group || strings.HasPrefix(fullPath, group+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// showNamespace returns true if the namespace with the given full path can
+// hold projects passing the Groups filter.
+func (opts *Options) showNamespace(fullPath string) bool {
+	if len(opts.Groups) == 0 || opts.inGroups(fullPath) {
+		return true
+	}
+	for _, group := range opts.Groups {
+		if strings.HasPrefix(group, fullPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// showProject returns true if the project with the given full path passes the
+// include and exclude patterns.
+func (opts *Options) showProject(fullPath string) bool {
+	if len(opts.IncludeProjects) != 0 && !matchAny(opts.IncludeProjects, fullPath) {
+		return false
+	}
+	return !matchAny(opts.ExcludeProjects, fullPath)
+}
+
+// showSubtree returns true if the given project subdirectory is enabled.
+func (opts *Options) showSubtree(name string) bool {
+	if len(opts.Subtrees) == 0 {
+		return true
+	}
+	for _, s := range opts.Subtrees {
+		if s == name {
+			return true
+		}
+	}
+	return false
 }
 
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Version is the version of gitlab-fuse, shown in .gitlabfs/version. It is set
+// when building releases, using
+// -ldflags "-X github.com/JonathonReinhart/gitlab-fuse/gitlabfs.Version=..."
+var Version = "devel"
+
 type GitlabFs struct {
 	client *GitlabClient
 	root   *rootNode
 	debug  *log.Logger
+	info   *log.Logger // The results of commands written to ctl files
 	opts   *Options
+	conn   *nodefs.FileSystemConnector
+
+	// Whether debug logging is enabled, i.e. not discarded
+	debugging int32
+
+	// Incremented to make jobs/ directories list all jobs again
+	jobsSyncGen int32
+
+	// When the filesystem was created, the time of .gitlabfs
+	started sharedTime
+
+	// The latest errors, for .gitlabfs/errors
+	errors errorLog
 }
 
 func NewGitlabFs(client *gitlab.Client, opts *Options) *GitlabFs {
@@ -64,7 +289,11 @@ func NewGitlabFs(client *gitlab.Client, opts *Options) *GitlabFs {
 	}
 	fs.root = NewRootNode(fs)
 
+	now := time.Now()
+	fs.started.update(&now)
+
 	fs.debug = log.New(ioutil.Discard, "DEBUG: ", log.Lshortfile|log.LstdFlags)
+	fs.info = log.New(os.Stderr, "", log.LstdFlags)
 
 	return fs
 }
@@ -73,120 +302,586 @@ func (fs *GitlabFs) Root() nodefs.Node {
 	return fs.root
 }
 
+// CheckAccess checks that GitLab can be reached and accepts the credentials.
+// A failure is also kept in .gitlabfs/errors.
+func (fs *GitlabFs) CheckAccess() error {
+	_, _, err := fs.client.Users.CurrentUser()
+	if err != nil {
+		fs.errors.add(time.Now(), fmt.Sprintf("CurrentUser() error: %v", err))
+	}
+	return err
+}
+
 func (fs *GitlabFs) SetDebugLogOutput(w io.Writer) {
+	debugging := int32(1)
+	if w == ioutil.Discard {
+		debugging = 0
+	}
+	atomic.StoreInt32(&fs.debugging, debugging)
+
 	fs.debug.SetOutput(w)
 	fs.client.SetDebugLogOutput(w)
+	if fs.opts.ArtifactCache != nil {
+		fs.opts.ArtifactCache.SetDebugLogOutput(w)
+	}
+	if fs.opts.RetryTransport != nil {
+		fs.opts.RetryTransport.SetDebugLogOutput(w)
+	}
 }
 
-func (fs *GitlabFs) onMount() {
-	fs.debug.Println("onMount()")
+// ResyncJobs makes every jobs/ directory list all of its jobs again the next
+// time it is accessed, instead of only the ones newer than it already has.
+func (fs *GitlabFs) ResyncJobs() {
+	fs.debug.Println("ResyncJobs()")
+	atomic.AddInt32(&fs.jobsSyncGen, 1)
+}
 
-	prjmap, err := fs.client.GetAllVisibleProjects()
-	if err != nil {
-		// TODO: Not sure how to make this error visible
-		// Maybe this fetch should actually go somewhere
-		// earlier, and then we just populate the inodes here.
-		panic(err)
+// Refresh makes every directory fetch its contents again the next time it is
+// accessed, however recently it was updated.
+func (fs *GitlabFs) Refresh() {
+	fs.debug.Println("Refresh()")
+	fs.refresh(fs.root.Inode(), false)
+}
+
+func (fs *GitlabFs) jobsSyncGeneration() int32 {
+	return atomic.LoadInt32(&fs.jobsSyncGen)
+}
+
+// addProject adds a project, and the namespaces leading to it, or updates it
+// if it was added before.
+func (fs *GitlabFs) addProject(prj *gitlab.Project) *nodefs.Inode {
+	ns := prj.Namespace.FullPath
+	nsInode := fs.getNamespaceInode(ns, prj.Namespace.Kind)
+	fs.updateNamespaceTimes(ns, prj.LastActivityAt)
+
+	if ch := nsInode.GetChild(prj.Path); ch != nil {
+		if prjNode, ok := ch.Node().(*projectNode); ok {
+			prjNode.update(prj)
+		}
+		return ch
+	}
+
+	// The project's directories all share its last activity time
+	activity := newSharedTime(prj.LastActivityAt)
+
+	prjNode := &projectNode{
+		Node:     nodefs.NewDefaultNode(),
+		fs:       fs,
+		path:     prj.Path,
+		activity: activity,
+		desc: &projectDescNode{
+			Node:     nodefs.NewDefaultNode(),
+			fs:       fs,
+			prjID:    prj.ID,
+			activity: activity,
+			desc:     prj.Description,
+		},
+	}
+	prjInode := nsInode.NewChild(prj.Path, true, prjNode)
+
+	// Add project contents to project
+	prjInode.NewChild("description", false, prjNode.desc)
+
+	if prj.RepositoryAccessLevel != gitlab.DisabledAccessControl && fs.opts.showSubtree("repo") {
+		fs.addProjectRepoDir(prjInode, prj.ID, activity)
+	}
+
+	if prj.IssuesEnabled && fs.opts.showSubtree("issues") {
+		prjInode.NewChild("issues", true,
+			&projectIssuesNode{
+				Node:     nodefs.NewDefaultNode(),
+				fs:       fs,
+				prjID:    prj.ID,
+				activity: activity,
+			})
+	}
+
+	if prj.MergeRequestsEnabled && fs.opts.showSubtree("merge_requests") {
+		prjInode.NewChild("merge_requests", true,
+			&projectMergeRequestsNode{
+				Node:     nodefs.NewDefaultNode(),
+				fs:       fs,
+				prjID:    prj.ID,
+				activity: activity,
+			})
+	}
+
+	if prj.JobsEnabled && fs.opts.showSubtree("jobs") {
+		jobsInode := prjInode.NewChild("jobs", true,
+			&projectJobsNode{
+				Node:     nodefs.NewDefaultNode(),
+				fs:       fs,
+				prjID:    prj.ID,
+				activity: activity,
+			})
+		jobsInode.NewChild(".refresh", false, NewRefreshFileNode(fs))
+	}
+
+	if prj.JobsEnabled && fs.opts.showSubtree("pipelines") {
+		pipelinesInode := prjInode.NewChild("pipelines", true,
+			&projectPipelinesNode{
+				Node:     nodefs.NewDefaultNode(),
+				fs:       fs,
+				prjID:    prj.ID,
+				activity: activity,
+			})
+		pipelinesInode.NewChild(".refresh", false, NewRefreshFileNode(fs))
 	}
 
-	// Add namespaces to root
-	for ns, projects := range prjmap {
-		nsNode := &namespaceNode{
-			Node: nodefs.NewDefaultNode(),
-			fs:   fs,
-			path: ns,
+	return prjInode
+}
+
+// getNamespaceInode returns the inode for the namespace with the given full
+// path (e.g. "group/subgroup") and kind ("group" or "user"), creating a
+// namespaceNode for every path segment that does not exist yet.
+func (fs *GitlabFs) getNamespaceInode(fullPath, kind string) *nodefs.Inode {
+	inode := fs.root.Inode()
+	path := ""
+
+	for _, name := range strings.Split(fullPath, "/") {
+		if path == "" {
+			path = name
+		} else {
+			path = path + "/" + name
 		}
-		nsInode := fs.root.Inode().NewChild(ns, true, nsNode)
 
-		// Add projects to namespace
-		for _, prj := range projects {
-			prjNode := &projectNode{
-				Node: nodefs.NewDefaultNode(),
-				fs:   fs,
-				path: prj.Path,
-			}
-			prjInode := nsInode.NewChild(prj.Path, true, prjNode)
-
-			// Add project contents to project
-			prjInode.NewChild("description", false,
-				&projectDescNode{
-					Node:  nodefs.NewDefaultNode(),
-					fs:    fs,
-					prjID: prj.ID,
-				})
-
-			if prj.JobsEnabled {
-				prjInode.NewChild("jobs", true,
-					&projectJobsNode{
-						Node:  nodefs.NewDefaultNode(),
-						fs:    fs,
-						prjID: prj.ID,
-					})
+		child := inode.GetChild(name)
+		if child == nil {
+			// Only groups have subgroups
+			childKind := "group"
+			if path == fullPath {
+				childKind = kind
 			}
+			child = inode.NewChild(name, true, NewNamespaceNode(fs, path, childKind))
+		}
+		inode = child
+	}
+
+	return inode
+}
+
+// updateNamespaceTimes updates the times of the namespace with the given full
+// path, and its parents, to include the activity of a project in it.
+func (fs *GitlabFs) updateNamespaceTimes(fullPath string, activity *time.Time) {
+	inode := fs.root.Inode()
+	for _, name := range strings.Split(fullPath, "/") {
+		inode = inode.GetChild(name)
+		if inode == nil {
+			return
+		}
+		if ns, ok := inode.Node().(*namespaceNode); ok {
+			ns.activity.update(activity)
+		}
+	}
+}
+
+func (fs *GitlabFs) artifactCacheKey(prjID, jobID int) ArtifactCacheKey {
+	return ArtifactCacheKey{
+		Host:      fs.client.BaseURL().Host,
+		ProjectID: prjID,
+		JobID:     jobID,
+	}
+}
+
+// openArtifactsArchive returns a job's artifacts archive, opened for reading.
+// If the artifacts are cacheable (i.e. the job has finished), they are taken
+// from, or stored in, the artifact cache. Otherwise, they are downloaded to
+// an unlinked temporary file.
+func (fs *GitlabFs) openArtifactsArchive(prjID, jobID int, cacheable bool) (*os.File, error) {
+	download := func(w io.Writer) error {
+		fs.debug.Printf("Getting artifact archive for prjID=%d, jobID=%d\n", prjID, jobID)
+		err := fs.client.DownloadJobArtifacts(prjID, jobID, w)
+		if err != nil {
+			fs.errorf("DownloadJobArtifacts(prjID=%d jobID=%d) failed: %v\n", prjID, jobID, err)
+		}
+		return err
+	}
+
+	if cache := fs.opts.ArtifactCache; cache != nil && cacheable {
+		key := fs.artifactCacheKey(prjID, jobID)
+		if f := cache.Get(key); f != nil {
+			return f, nil
+		}
+
+		// Only one of several concurrent callers downloads the archive;
+		// the others then take it from the cache.
+		var f *os.File
+		_, err := fs.client.requests.Do(requestKey("CacheArtifacts", key), func() (interface{}, error) {
+			var err error
+			f, err = cache.Put(key, download)
+			return nil, err
+		})
+		if err != nil {
+			fs.errorf("Caching artifact archive failed: %v\n", err)
+			return nil, err
+		}
+		if f != nil {
+			return f, nil
+		}
+		if f := cache.Get(key); f != nil {
+			return f, nil
 		}
+		// It wasn't kept (e.g. too big for the cache); get our own copy
+	}
+
+	f, err := UnlinkedTempFile("", "gitlab-fuse-artifact")
+	if err != nil {
+		fs.errorf("UnlinkedTempFile() failed: %v\n", err)
+		return nil, err
+	}
+
+	if err := download(f); err != nil {
+		f.Close()
+		return nil, err
 	}
 
+	f.Seek(0, os.SEEK_SET)
+	return f, nil
+}
+
+// errorStatus returns the status to report to the kernel for an error, so
+// that e.g. a missing permission can be told apart from GitLab being down.
+func errorStatus(err error) fuse.Status {
+	switch apiStatusCode(err) {
+	case http.StatusBadRequest:
+		return fuse.EINVAL
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fuse.EACCES
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return fuse.EAGAIN
+	case http.StatusGatewayTimeout:
+		return fuse.Status(syscall.ETIMEDOUT)
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrUnsupportedArchive):
+		return fuse.Status(syscall.ENOTSUP)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return fuse.Status(syscall.ETIMEDOUT)
+	}
+	return fuse.EIO
+}
+
+// removeChild removes the child called name from parent, and tells the kernel
+// to drop its cached entry.
+func (fs *GitlabFs) removeChild(parent *nodefs.Inode, name string) {
+	ch := parent.RmChild(name)
+	if ch == nil || fs.conn == nil {
+		return
+	}
+
+	// The kernel may be holding the parent directory locked while it waits
+	// for the request we're handling, so don't wait for it here.
+	go fs.conn.DeleteNotify(parent, ch, name)
+}
+
+// notifyChanged tells the kernel to drop what it cached about an inode which
+// was changed in place, e.g. a symlink pointed somewhere else.
+func (fs *GitlabFs) notifyChanged(inode *nodefs.Inode) {
+	if fs.conn == nil {
+		return
+	}
+
+	// As in removeChild, don't wait for the kernel
+	go fs.conn.FileNotify(inode, 0, 0)
 }
 
 /******************************************************************************/
 /* rootNode */
 
+// rootNode is the namespace holding all others.
 type rootNode struct {
-	nodefs.Node
-
-	// Back-reference to our overall fs object
-	fs *GitlabFs
+	*namespaceNode
 }
 
 func NewRootNode(fs *GitlabFs) *rootNode {
-	root := &rootNode{
-		Node: nodefs.NewDefaultNode(),
-		fs:   fs,
+	return &rootNode{
+		namespaceNode: NewNamespaceNode(fs, "", ""),
 	}
-
-	return root
 }
 
 func (r *rootNode) OnMount(c *nodefs.FileSystemConnector) {
-	r.fs.onMount()
+	r.fs.conn = c
+	r.fs.addControlDir()
 }
 
-func (r *rootNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	r.fs.debug.Printf("rootNode.Lookup(%q)\n", name)
-	return nil, fuse.ENOENT
+/******************************************************************************/
+/* Timestamps */
+
+// setTimes sets the access, modification and change times in out to t, unless
+// it is unknown.
+func setTimes(out *fuse.Attr, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	out.SetTimes(&t, &t, &t)
+}
+
+// timeOf returns an optional timestamp from the API, or the zero time.
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// sharedTime is a timestamp which is shared by several nodes, and may be
+// updated concurrently, e.g. the last activity of a project.
+type sharedTime struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newSharedTime(t *time.Time) *sharedTime {
+	st := &sharedTime{}
+	st.update(t)
+	return st
+}
+
+func (st *sharedTime) get() time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.t
+}
+
+// update sets the time to t, if it is later.
+func (st *sharedTime) update(t *time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if t != nil && t.After(st.t) {
+		st.t = *t
+	}
+}
+
+/*****/
+
+// dirNode is a plain directory, e.g. one grouping other nodes, with the time
+// of something related to it.
+type dirNode struct {
+	nodefs.Node
+	mtime *sharedTime
+}
+
+func NewDirNode(mtime *sharedTime) *dirNode {
+	return &dirNode{
+		Node:  nodefs.NewDefaultNode(),
+		mtime: mtime,
+	}
+}
+
+// dirAttr sets out to the attributes of a directory with the given time.
+func dirAttr(out *fuse.Attr, mtime time.Time) fuse.Status {
+	out.Mode = fuse.S_IFDIR | 0755
+	setTimes(out, mtime)
+	return fuse.OK
+}
+
+func (n *dirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mtime.get())
+}
+
+/*****/
+
+// lister keeps Lookup from waiting for a listing of a directory which was
+// listed before. go-fuse only calls Lookup for names it doesn't know yet, and
+// holds a lock stopping every other lookup on the mount while it runs. So once
+// a directory was listed, Lookup answers from the entries it has, and a
+// listing which is due is made in the background: a name which is new since
+// the last listing only appears once that is done.
+type lister struct {
+	listed  int32 // Set once a listing succeeded
+	pending int32 // Set while a background listing runs
+}
+
+// list lists a directory using fetch, which logs its errors.
+func (l *lister) list(fetch func() error) error {
+	err := fetch()
+	if err == nil {
+		atomic.StoreInt32(&l.listed, 1)
+	}
+	return err
+}
+
+// listForLookup is list for a Lookup. Only the first listing is waited for.
+func (l *lister) listForLookup(fetch func() error) error {
+	if atomic.LoadInt32(&l.listed) == 0 {
+		return l.list(fetch)
+	}
+	if atomic.CompareAndSwapInt32(&l.pending, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&l.pending, 0)
+			l.list(fetch)
+		}()
+	}
+	return nil
 }
 
 /******************************************************************************/
 /* Symlinks */
 
+// symlinkNode is a symlink, whose time is when it was last pointed somewhere
+// else.
 type symlinkNode struct {
 	nodefs.Node
-	link string
+
+	mu    sync.Mutex
+	link  string
+	mtime time.Time
 }
 
 func NewSymlinkNode(link string) *symlinkNode {
 	return &symlinkNode{
-		Node: nodefs.NewDefaultNode(),
-		link: link,
+		Node:  nodefs.NewDefaultNode(),
+		link:  link,
+		mtime: time.Now(),
 	}
 }
 
 func (n *symlinkNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	out.Mode = fuse.S_IFLNK | 0777
+	out.Size = uint64(len(n.link))
+	setTimes(out, n.mtime)
 	return fuse.OK
 }
 
 func (n *symlinkNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	return []byte(n.link), fuse.OK
 }
 
+// setSymlink points the symlink called name in parent at link, creating it if
+// it doesn't exist yet.
+func (fs *GitlabFs) setSymlink(parent *nodefs.Inode, name, link string) {
+	if ch := parent.GetChild(name); ch != nil {
+		if sl, ok := ch.Node().(*symlinkNode); ok {
+			sl.mu.Lock()
+			changed := sl.link != link
+			if changed {
+				sl.link = link
+				sl.mtime = time.Now()
+			}
+			sl.mu.Unlock()
+
+			if changed {
+				fs.notifyChanged(ch)
+			}
+			return
+		}
+		fs.removeChild(parent, name)
+	}
+	parent.NewChild(name, false, NewSymlinkNode(link))
+}
+
+/******************************************************************************/
+/* Static files */
+
+// staticFileNode is a read-only file with fixed contents. To change them,
+// replace the node using setStaticFile.
+type staticFileNode struct {
+	nodefs.Node
+	data  []byte
+	mtime time.Time
+}
+
+func NewStaticFileNode(data string, mtime time.Time) *staticFileNode {
+	return &staticFileNode{
+		Node:  nodefs.NewDefaultNode(),
+		data:  []byte(data),
+		mtime: mtime,
+	}
+}
+
+func (n *staticFileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.data))
+	setTimes(out, n.mtime)
+	return fuse.OK
+}
+
+func (n *staticFileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	return nodefs.NewDataFile(n.data), fuse.OK
+}
+
+// newVolatileDataFile returns an open file serving data which may differ from
+// what the node reported before it was opened. Reads bypass the page cache, so
+// they are not cut short at a stale size.
+func newVolatileDataFile(data []byte) nodefs.File {
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(data),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}
+}
+
+// setStaticFile sets the contents and time of the static file called name in
+// parent, creating it if it doesn't exist yet. A file with other contents is
+// replaced, and the kernel told to drop the old one.
+func (fs *GitlabFs) setStaticFile(parent *nodefs.Inode, name, data string, mtime time.Time) {
+	if ch := parent.GetChild(name); ch != nil {
+		if sf, ok := ch.Node().(*staticFileNode); ok && string(sf.data) == data && sf.mtime.Equal(mtime) {
+			return
+		}
+		fs.removeChild(parent, name)
+	}
+	parent.NewChild(name, false, NewStaticFileNode(data, mtime))
+}
+
 /******************************************************************************/
-/* Namespace */
+/* Record attributes */
 
-type namespaceNode struct {
+// attrFileNode is a read-only file holding a single value from the most
+// recently fetched record of something, e.g. a job's status or an issue's
+// title. The value is followed by a newline, unless it is empty, in which case
+// so is the file.
+type attrFileNode struct {
 	nodefs.Node
-	fs   *GitlabFs
-	path string
+
+	// get returns the value from the most recently fetched record, and
+	// mtime the time of the record
+	get   func() string
+	mtime func() time.Time
+
+	// If set, refresh is called when the file is opened, to fetch the
+	// record again if it may have changed
+	refresh func() error
+}
+
+func (n *attrFileNode) data() []byte {
+	value := n.get()
+	if value == "" {
+		return nil
+	}
+	return []byte(value + "\n")
+}
+
+func (n *attrFileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, n.mtime())
+	if file != nil {
+		return file.GetAttr(out)
+	}
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.data()))
+	return fuse.OK
+}
+
+func (n *attrFileNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if n.refresh != nil {
+		if err := n.refresh(); err != nil {
+			return nil, errorStatus(err)
+		}
+	}
+	return newVolatileDataFile(n.data()), fuse.OK
 }
 
 /******************************************************************************/
@@ -194,8 +889,20 @@ type namespaceNode struct {
 
 type projectNode struct {
 	nodefs.Node
-	fs   *GitlabFs
-	path string
+	fs       *GitlabFs
+	path     string
+	activity *sharedTime
+	desc     *projectDescNode
+}
+
+// update takes in a newer record of the project.
+func (n *projectNode) update(prj *gitlab.Project) {
+	n.activity.update(prj.LastActivityAt)
+	n.desc.setDesc(prj.Description)
+}
+
+func (n *projectNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
 }
 
 func (n *projectNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
@@ -208,8 +915,19 @@ func (n *projectNode) Lookup(out *fuse.Attr, name string, context *fuse.Context)
 
 type projectDescNode struct {
 	nodefs.Node
-	fs    *GitlabFs
-	prjID int
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	// The most recently fetched description
+	mu   sync.Mutex
+	desc string
+}
+
+func (n *projectDescNode) data() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return []byte(n.desc + "\n")
 }
 
 func (n *projectDescNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
@@ -217,123 +935,342 @@ func (n *projectDescNode) Open(flags uint32, context *fuse.Context) (nodefs.File
 	if flags&fuse.O_ANYWRITE != 0 {
 		return nil, fuse.EPERM
 	}
-	prj, _, err := n.fs.client.Projects.GetProject(n.prjID, nil)
+	prj, err := n.fs.client.GetProject(n.prjID)
 	if err != nil {
-		log.Printf("GetProject(%d) error: %v\n", n.prjID, err)
-		return nil, fuse.EIO
+		n.fs.errorf("GetProject(%d) error: %v\n", n.prjID, err)
+		return nil, errorStatus(err)
 	}
+	n.activity.update(prj.LastActivityAt)
 
-	return nodefs.NewDataFile([]byte(prj.Description + "\n")), fuse.OK
+	n.setDesc(prj.Description)
+
+	return newVolatileDataFile(n.data()), fuse.OK
+}
+
+func (n *projectDescNode) setDesc(desc string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.desc = desc
 }
 
 func (n *projectDescNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, n.activity.get())
 	if file != nil {
 		return file.GetAttr(out)
 	}
 	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.data()))
 	return fuse.OK
 }
 
 /******************************************************************************/
 /* Project jobs */
 
+// Updates only list the new jobs, so jobs which were deleted (e.g. with their
+// pipeline), or whose artifacts were erased, would only be noticed when all of
+// them are listed again. Instead, each update fetches this many of the other
+// jobs again, going through all of them in turn.
+const jobsRecheckBatch = 10
+
 type projectJobsNode struct {
 	nodefs.Node
-	fs         *GitlabFs
-	prjID      int
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	lister
+
+	// Held while updating the children
+	mu         sync.Mutex
 	lastUpdate time.Time
+
+	// The newest job from the last listing. Updates only list newer jobs,
+	// unless it is zero.
+	maxJobID int
+
+	// Jobs which are not listed by updates, but whose state should be
+	// fetched again after the given time: unfinished jobs (immediately),
+	// and jobs whose artifacts expire.
+	recheck map[int]time.Time
+
+	// The last of the other jobs fetched again by an update
+	lastRechecked int
+
+	// The value of fs.jobsSyncGen when all jobs were last listed
+	syncGen int32
+}
+
+func (n *projectJobsNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Only the new jobs are listed
+	n.lastUpdate = time.Time{}
+}
+
+func (n *projectJobsNode) resync() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lastUpdate = time.Time{}
+	n.maxJobID = 0
 }
 
-func (n *projectJobsNode) fetch() bool {
+func (n *projectJobsNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Has a full re-sync been requested?
+	if syncGen := n.fs.jobsSyncGeneration(); syncGen != n.syncGen {
+		n.syncGen = syncGen
+		n.lastUpdate = time.Time{}
+		n.maxJobID = 0
+	}
+	fullSync := n.maxJobID == 0
+
 	sinceLastUpdate := time.Since(n.lastUpdate)
-	n.fs.debug.Printf("projectJobsNode.fetch() sinceLastUpdate=%v\n", sinceLastUpdate)
+	n.fs.debug.Printf("projectJobsNode.fetch() sinceLastUpdate=%v fullSync=%v\n", sinceLastUpdate, fullSync)
 
 	// Is it time to update yet?
 	if sinceLastUpdate < n.fs.opts.MinJobsDirUpdateDelay {
 		// Not time yet
-		return true
+		return nil
 	}
 	n.lastUpdate = time.Now()
 
 	// Look up this project's info
-	prj, _, err := n.fs.client.Projects.GetProject(n.prjID, nil)
+	prj, err := n.fs.client.GetProject(n.prjID)
 	if err != nil {
-		log.Printf("GetProject(%d) error: %v\n", n.prjID, err)
-		return false
+		n.fs.errorf("GetProject(%d) error: %v\n", n.prjID, err)
+		return err
 	}
 
+	n.activity.update(prj.LastActivityAt)
+
 	if !prj.JobsEnabled {
 		// TODO: ENOENT?
-		return true
+		return nil
 	}
 
-	// Get all of the jobs from the API
-	jobs, err := n.fs.client.GetAllProjectJobs(prj.ID)
+	// Get the jobs newer than the ones we have from the API (all of them,
+	// for a full re-sync). A full re-sync failing leaves maxJobID at zero,
+	// so the next update tries again.
+	jobs, err := n.fs.client.GetNewProjectJobs(prj.ID, n.maxJobID)
 	if err != nil {
-		log.Printf("GetAllProjectJobs() error: %v\n", prj.PathWithNamespace, err)
-		return false
+		n.fs.errorf("GetNewProjectJobs(%s, %d) error: %v\n", prj.PathWithNamespace, n.maxJobID, err)
+		return err
 	}
 
-	// Get a map of all existing job inodes
-	existing := n.Inode().Children()
-
-	// Add new ones
-	maxjobID := 0
+	// Add new ones, and update the others
+	listed := make(map[int]bool)
+	maxJobID := n.maxJobID
 	for _, job := range jobs {
-		if job.ID > maxjobID {
-			maxjobID = job.ID
+		if job.ID > maxJobID {
+			maxJobID = job.ID
 		}
+		listed[job.ID] = true
+		n.setJob(job)
+	}
 
-		jobName := strconv.Itoa(job.ID)
-
-		_, exists := existing[jobName]
-		if !exists {
-			n.addNewJobDirNode(job)
+	// Remove jobs which no longer exist. Only a full listing tells us about
+	// all of them.
+	if fullSync {
+		for name := range n.Inode().Children() {
+			jobID, err := strconv.Atoi(name)
+			if err == nil && !listed[jobID] {
+				n.removeJob(jobID)
+			}
+		}
+	}
+	n.maxJobID = maxJobID
+
+	// Get the current state of the jobs older than the new ones which may
+	// have changed, and of a batch of the others
+	now := time.Now()
+	var recheck []int
+	for jobID, after := range n.recheck {
+		if !listed[jobID] && !now.Before(after) {
+			recheck = append(recheck, jobID)
+			listed[jobID] = true
+		}
+	}
+	if !fullSync {
+		recheck = append(recheck, n.nextRecheckBatch(listed)...)
+	}
+	for _, jobID := range recheck {
+		job, err := n.fs.client.GetJob(n.prjID, jobID)
+		if isNotFound(err) {
+			n.removeJob(jobID)
+			continue
+		}
+		if err != nil {
+			n.fs.errorf("GetJob(%d, %d) error: %v\n", n.prjID, jobID, err)
 			continue
 		}
+		n.setJob(job)
 	}
 
-	// TODO: Remove ones that no longer exist -- Can this even happen with GitLab?
-
 	// Make "latest" symlink
-	n.Inode().NewChild("latest", false, NewSymlinkNode(strconv.Itoa(maxjobID)))
+	n.fs.setSymlink(n.Inode(), "latest", strconv.Itoa(n.maxJobID))
 
-	return true
+	return nil
 }
 
-func (n *projectJobsNode) addNewJobDirNode(job *gitlab.Job) {
+// nextRecheckBatch returns the next jobsRecheckBatch jobs to fetch again,
+// skipping the given ones, and continuing after the ones returned last time
+// in order of their IDs. n.mu must be held.
+func (n *projectJobsNode) nextRecheckBatch(skip map[int]bool) []int {
+	var jobIDs []int
+	for name := range n.Inode().Children() {
+		if jobID, err := strconv.Atoi(name); err == nil && !skip[jobID] {
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	sort.Ints(jobIDs)
+
+	var batch []int
+	i := sort.SearchInts(jobIDs, n.lastRechecked+1)
+	for len(batch) < jobsRecheckBatch && len(batch) < len(jobIDs) {
+		if i == len(jobIDs) {
+			i = 0
+		}
+		batch = append(batch, jobIDs[i])
+		i++
+	}
+	if len(batch) != 0 {
+		n.lastRechecked = batch[len(batch)-1]
+	}
+	return batch
+}
+
+// setJob adds the directory of a job, or updates the existing one. n.mu must
+// be held.
+func (n *projectJobsNode) setJob(job *Job) {
+	if n.recheck == nil {
+		n.recheck = make(map[int]time.Time)
+	}
+	delete(n.recheck, job.ID)
+	if isJobActive(job.Status) {
+		n.recheck[job.ID] = time.Time{}
+	} else if job.ArtifactsFile.Filename != "" && job.ArtifactsExpireAt != nil &&
+		job.ArtifactsExpireAt.After(time.Now()) {
+		n.recheck[job.ID] = *job.ArtifactsExpireAt
+	}
+
+	ch := n.Inode().GetChild(strconv.Itoa(job.ID))
+	if ch == nil {
+		n.addNewJobDirNode(job)
+		return
+	}
+	if dir, ok := ch.Node().(*jobDirNode); ok {
+		dir.setJob(job)
+		n.updateJobDirNode(dir, job)
+	}
+}
+
+func (n *projectJobsNode) addNewJobDirNode(job *Job) {
 	n.fs.debug.Printf("Adding new job inode (%d) to project (%d)\n", job.ID, n.prjID)
 
-	fs := n.fs
-	prjID := n.prjID
-	jobID := job.ID
 	jobName := strconv.Itoa(job.ID)
 
 	// Add the jobs/1234 directory
-	jobDirInode := n.Inode().NewChild(jobName, true, nodefs.NewDefaultNode())
+	dir := &jobDirNode{
+		Node: nodefs.NewDefaultNode(),
+		jobs: n,
+		job:  job,
+	}
+	jobDirInode := n.Inode().NewChild(jobName, true, dir)
 
 	// Add the jobs/1234/xxx files
-	jobDirInode.NewChild("status", false, &jobStatusNode{
-		jobNode: NewJobNode(fs, prjID, jobID),
-	})
+	for name, get := range jobAttrs {
+		get := get
+		jobDirInode.NewChild(name, false, &attrFileNode{
+			Node:    nodefs.NewDefaultNode(),
+			get:     func() string { return get(dir.getJob()) },
+			mtime:   func() time.Time { return jobTime(dir.getJob()) },
+			refresh: dir.refreshLogged,
+		})
+	}
 	jobDirInode.NewChild("trace", false, &jobTraceNode{
-		jobNode: NewJobNode(fs, prjID, jobID),
+		jobNode: NewJobNode(dir),
 	})
-	jobDirInode.NewChild(job.ArtifactsFile.Filename, false, &jobArtifactsArchiveNode{
-		jobNode: NewJobNode(fs, prjID, jobID),
-		size:      uint64(job.ArtifactsFile.Size),
+	jobDirInode.NewChild("ctl", false, &jobCtlNode{
+		jobNode: NewJobNode(dir),
+		jobs:    n,
 	})
-	if job.ArtifactsFile.Size > 0 {
-		jobDirInode.NewChild("artifacts", true, NewJobArtifactsDirNode(fs, prjID, jobID))
+
+	n.updateJobDirNode(dir, job)
+}
+
+// updateJob adds or updates the directory of a job which was fetched outside
+// of an update.
+func (n *projectJobsNode) updateJob(job *Job) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.setJob(job)
+}
+
+// forgetJob removes the directory of a job which was found to no longer exist
+// outside of an update.
+func (n *projectJobsNode) forgetJob(jobID int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.removeJob(jobID)
+}
+
+// removeJob removes the directory of a job which no longer exists. n.mu must
+// be held.
+func (n *projectJobsNode) removeJob(jobID int) {
+	n.fs.debug.Printf("Removing job inode (%d) from project (%d)\n", jobID, n.prjID)
+
+	delete(n.recheck, jobID)
+	n.fs.removeChild(n.Inode(), strconv.Itoa(jobID))
+}
+
+// updateJobDirNode adds the artifacts of a job to its directory once it has
+// them, and removes them once they have expired or were erased.
+func (n *projectJobsNode) updateJobDirNode(dir *jobDirNode, job *Job) {
+	fs := n.fs
+	jobID := job.ID
+	jobDirInode := dir.Inode()
+
+	for name, ch := range jobDirInode.Children() {
+		switch ch.Node().(type) {
+		case *jobArtifactsArchiveNode:
+			if name != job.ArtifactsFile.Filename {
+				fs.debug.Printf("Removing artifacts archive of job (%d)\n", jobID)
+				fs.removeChild(jobDirInode, name)
+			} else {
+				ch.Node().(*jobArtifactsArchiveNode).setSize(uint64(job.ArtifactsFile.Size))
+			}
+		case *jobArtifactsDirNode:
+			if job.ArtifactsFile.Size == 0 {
+				fs.debug.Printf("Removing artifacts/ of job (%d)\n", jobID)
+				fs.removeChild(jobDirInode, name)
+			}
+		}
+	}
+
+	if name := job.ArtifactsFile.Filename; name != "" && jobDirInode.GetChild(name) == nil {
+		jobDirInode.NewChild(name, false, &jobArtifactsArchiveNode{
+			jobNode: NewJobNode(dir),
+			size:    uint64(job.ArtifactsFile.Size),
+		})
+	}
+	if job.ArtifactsFile.Size > 0 && jobDirInode.GetChild("artifacts") == nil {
+		jobDirInode.NewChild("artifacts", true, NewJobArtifactsDirNode(dir))
 	}
+}
 
+func (n *projectJobsNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
 }
 
 func (n *projectJobsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	n.fs.debug.Printf("projectJobsNode.OpenDir(%d)\n", n.prjID)
 
-	if !n.fetch() {
-		return nil, fuse.EIO
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
 	}
 
 	return n.Node.OpenDir(context)
@@ -342,12 +1279,34 @@ func (n *projectJobsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.
 func (n *projectJobsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	n.fs.debug.Printf("projectJobsNode.Lookup(%q)\n", name)
 
-	if !n.fetch() {
-		return nil, fuse.EIO
+	jobID, err := strconv.Atoi(name)
+	if err != nil || strconv.Itoa(jobID) != name {
+		// Only "latest" is not a job, and it is made by listing
+		if err := n.listForLookup(n.fetch); err != nil {
+			return nil, errorStatus(err)
+		}
+		ch := n.Inode().GetChild(name)
+		if ch == nil {
+			return nil, fuse.ENOENT
+		}
+		return ch, ch.Node().GetAttr(out, nil, context)
 	}
+
+	// A job we don't have yet, e.g. one newer than our last update which is
+	// referenced from pipelines/, is looked up directly, without listing.
 	ch := n.Inode().GetChild(name)
 	if ch == nil {
-		return nil, fuse.ENOENT
+		job, err := n.fs.client.GetJob(n.prjID, jobID)
+		if isNotFound(err) {
+			return nil, fuse.ENOENT
+		}
+		if err != nil {
+			n.fs.errorf("GetJob(%d, %d) error: %v\n", n.prjID, jobID, err)
+			return nil, errorStatus(err)
+		}
+
+		n.updateJob(job)
+		ch = n.Inode().GetChild(name)
 	}
 
 	return ch, ch.Node().GetAttr(out, nil, context)
@@ -360,18 +1319,23 @@ type jobNode struct {
 	fs    *GitlabFs
 	prjID int
 	jobID int
+
+	// The directory of the job, which holds its record
+	dir *jobDirNode
 }
 
-func NewJobNode(fs *GitlabFs, prjID, jobID int) jobNode {
+func NewJobNode(dir *jobDirNode) jobNode {
 	return jobNode{
 		Node:  nodefs.NewDefaultNode(),
-		fs:    fs,
-		prjID: prjID,
-		jobID: jobID,
+		fs:    dir.jobs.fs,
+		prjID: dir.jobs.prjID,
+		jobID: dir.getJob().ID,
+		dir:   dir,
 	}
 }
 
 func (n *jobNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, jobTime(n.dir.getJob()))
 	if file != nil {
 		return file.GetAttr(out)
 	}
@@ -379,30 +1343,306 @@ func (n *jobNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Contex
 	return fuse.OK
 }
 
+// isJobActive returns true if a job with the given status may still change,
+// i.e. it has not finished yet.
+func isJobActive(status string) bool {
+	switch status {
+	case "created", "waiting_for_resource", "preparing", "pending", "running":
+		return true
+	}
+	return false
+}
+
+/******************************************************************************/
+/* jobs/<id>/ */
+
+type jobDirNode struct {
+	nodefs.Node
+	jobs *projectJobsNode
+
+	mu  sync.Mutex
+	job *Job
+}
+
+// getJob returns the most recently fetched job record.
+func (n *jobDirNode) getJob() *Job {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.job
+}
+
+func (n *jobDirNode) setJob(job *Job) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.job = job
+}
+
+// refresh fetches the job record again, if the job may have changed since.
+func (n *jobDirNode) refresh() error {
+	job := n.getJob()
+	if !isJobActive(job.Status) {
+		return nil
+	}
+
+	jobID := job.ID
+	job, err := n.jobs.fs.client.GetJob(n.jobs.prjID, jobID)
+	if isNotFound(err) {
+		// Deleted since the last update
+		n.jobs.forgetJob(jobID)
+	}
+	if err != nil {
+		return err
+	}
+	n.jobs.updateJob(job)
+	return nil
+}
+
+// refreshLogged is refresh, logging a failure, for the files holding values
+// from the job record. Unfinished jobs are fetched again when they are opened.
+func (n *jobDirNode) refreshLogged() error {
+	err := n.refresh()
+	if err != nil {
+		n.jobs.fs.errorf("GetJob(%d, %d) error: %v\n", n.jobs.prjID, n.getJob().ID, err)
+	}
+	return err
+}
+
+// jobTime returns the time of the latest thing which happened to a job.
+func jobTime(job *Job) time.Time {
+	for _, t := range []*time.Time{job.FinishedAt, job.StartedAt, job.CreatedAt} {
+		if t != nil {
+			return *t
+		}
+	}
+	return time.Time{}
+}
+
+func (n *jobDirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, jobTime(n.getJob()))
+}
+
+/*****/
+
+// formatTime formats an optional timestamp, e.g. a job's started_at.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// jobAttrs are the files in a job directory holding a single value (without
+// the trailing newline) from the job record.
+var jobAttrs = map[string]func(*Job) string{
+	"status": func(job *Job) string { return job.Status },
+	"name":   func(job *Job) string { return job.Name },
+	"stage":  func(job *Job) string { return job.Stage },
+	"ref":    func(job *Job) string { return job.Ref },
+	"commit": func(job *Job) string {
+		if job.Commit == nil {
+			return ""
+		}
+		return job.Commit.ID
+	},
+	"user": func(job *Job) string {
+		if job.User == nil {
+			return ""
+		}
+		return job.User.Username
+	},
+	"runner": func(job *Job) string { return job.Runner.Description },
+	"duration": func(job *Job) string {
+		if job.StartedAt == nil {
+			return ""
+		}
+		return strconv.FormatFloat(job.Duration, 'f', -1, 64)
+	},
+	"created_at":     func(job *Job) string { return formatTime(job.CreatedAt) },
+	"started_at":     func(job *Job) string { return formatTime(job.StartedAt) },
+	"finished_at":    func(job *Job) string { return formatTime(job.FinishedAt) },
+	"failure_reason": func(job *Job) string { return job.FailureReason },
+	"web_url":        func(job *Job) string { return job.WebURL },
+	"job.json": func(job *Job) string {
+		buf, _ := json.MarshalIndent(job, "", "  ")
+		return string(buf)
+	},
+}
+
 /******************************************************************************/
-/* jobs/<id>/status */
+/* jobs/<id>/ctl */
 
-type jobStatusNode struct {
+// jobCtlNode is a write-only file which runs the commands written to it on the
+// job.
+type jobCtlNode struct {
 	jobNode
+	jobs *projectJobsNode
 }
 
-func (n *jobStatusNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
-	if flags&fuse.O_ANYWRITE != 0 {
+func (n *jobCtlNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0200
+	setTimes(out, jobTime(n.dir.getJob()))
+	return fuse.OK
+}
+
+func (n *jobCtlNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE == 0 {
 		return nil, fuse.EPERM
 	}
-	job, _, err := n.fs.client.Jobs.GetJob(n.prjID, n.jobID)
+	return &jobCtlFile{
+		File: nodefs.NewDefaultFile(),
+		node: n,
+	}, fuse.OK
+}
+
+// Truncate accepts the truncation done by e.g. "echo retry > ctl".
+func (n *jobCtlNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
+// run runs a single command, logging the result.
+func (n *jobCtlNode) run(cmd string) fuse.Status {
+	var job *gitlab.Job
+	var err error
+
+	switch cmd {
+	case "retry":
+		job, _, err = n.fs.client.Jobs.RetryJob(n.prjID, n.jobID)
+	case "cancel":
+		job, _, err = n.fs.client.Jobs.CancelJob(n.prjID, n.jobID)
+	case "play":
+		job, _, err = n.fs.client.Jobs.PlayJob(n.prjID, n.jobID)
+	case "erase":
+		job, _, err = n.fs.client.Jobs.EraseJob(n.prjID, n.jobID)
+	default:
+		n.fs.errorf("Job %d (prjID=%d): unknown command %q\n", n.jobID, n.prjID, cmd)
+		return fuse.EINVAL
+	}
 	if err != nil {
-		log.Printf("GetJob(%d, %d) error: %v\n", n.prjID, n.jobID, err)
-		return nil, fuse.EIO
+		n.fs.errorf("Job %d (prjID=%d): %s failed: %v\n", n.jobID, n.prjID, cmd, err)
+		return errorStatus(err)
+	}
+
+	if job.ID != n.jobID {
+		n.fs.info.Printf("Job %d (prjID=%d): %s: created job %d (%s)\n", n.jobID, n.prjID, cmd, job.ID, job.Status)
+	} else {
+		n.fs.info.Printf("Job %d (prjID=%d): %s: %s\n", n.jobID, n.prjID, cmd, job.Status)
+	}
+
+	// Show the new state (or job) right away. The record returned by the
+	// command lacks some of the fields we show (e.g. erased_at), so fetch
+	// the whole one; if that fails, the next update shows it.
+	newJob, err := n.fs.client.GetJob(n.prjID, job.ID)
+	if err != nil {
+		n.fs.errorf("GetJob(%d, %d) error: %v\n", n.prjID, job.ID, err)
+		return fuse.OK
+	}
+	n.jobs.updateJob(newJob)
+	return fuse.OK
+}
+
+type jobCtlFile struct {
+	nodefs.File
+	node *jobCtlNode
+}
+
+func (f *jobCtlFile) String() string {
+	return fmt.Sprintf("jobCtlFile(%d, %d)", f.node.prjID, f.node.jobID)
+}
+
+// Write runs each whitespace-separated command in data, stopping at the
+// first one which fails.
+func (f *jobCtlFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	for _, cmd := range strings.Fields(string(data)) {
+		if status := f.node.run(cmd); !status.Ok() {
+			return 0, status
+		}
 	}
-	return nodefs.NewDataFile([]byte(job.Status + "\n")), fuse.OK
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *jobCtlFile) Truncate(size uint64) fuse.Status {
+	return fuse.OK
 }
 
 /******************************************************************************/
 /* jobs/<id>/trace */
 
+// jobTraceNode is a job's trace. The output is fetched when the trace is
+// opened, and kept until it is closed; while the job is active, reads past its
+// end fetch new output, at most every MinTraceUpdateDelay. The size reported
+// by GetAttr never needs a fetch: it is that of the output while the trace is
+// open, or else that of the archived trace of a finished job, or the size the
+// trace had when it was last closed (0 if it never was). Since reads bypass the
+// page cache, a size which is out of date doesn't cut them short.
 type jobTraceNode struct {
 	jobNode
+
+	mu        sync.Mutex
+	buf       []byte
+	finished  bool
+	lastFetch time.Time
+	openCount int
+	lastSize  uint64
+}
+
+// archivedTraceSize returns the size of a job's archived trace, if it has one.
+func archivedTraceSize(job *Job) (uint64, bool) {
+	for _, a := range job.Artifacts {
+		if a.FileType == "trace" {
+			return uint64(a.Size), true
+		}
+	}
+	return 0, false
+}
+
+// update fetches new trace output, if the job is still active. n.mu must be
+// held.
+func (n *jobTraceNode) update() error {
+	if n.finished || time.Since(n.lastFetch) < n.fs.opts.MinTraceUpdateDelay {
+		return nil
+	}
+	n.lastFetch = time.Now()
+
+	// Get the status first; if the job has finished, the trace we fetch
+	// next is complete.
+	job, err := n.fs.client.GetJob(n.prjID, n.jobID)
+	if err != nil {
+		return err
+	}
+
+	data, err := n.fs.client.GetTraceFrom(n.prjID, n.jobID, int64(len(n.buf)))
+	if err != nil {
+		return err
+	}
+
+	n.buf = append(n.buf, data...)
+	n.finished = !isJobActive(job.Status)
+	n.dir.jobs.updateJob(job)
+	return nil
+}
+
+// size returns the size of the trace, without fetching anything. n.mu must be
+// held.
+func (n *jobTraceNode) size() uint64 {
+	if n.openCount > 0 {
+		return uint64(len(n.buf))
+	}
+	job := n.dir.getJob()
+	if size, ok := archivedTraceSize(job); ok && !isJobActive(job.Status) {
+		return size
+	}
+	return n.lastSize
+}
+
+func (n *jobTraceNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, jobTime(n.dir.getJob()))
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = n.size()
+	return fuse.OK
 }
 
 func (n *jobTraceNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
@@ -410,19 +1650,81 @@ func (n *jobTraceNode) Open(flags uint32, context *fuse.Context) (nodefs.File, f
 		return nil, fuse.EPERM
 	}
 
-	traceReader, _, err := n.fs.client.Jobs.GetTraceFile(n.prjID, n.jobID)
-	if err != nil {
-		log.Printf("GetTraceFile(%d, %d) error: %v\n", n.prjID, n.jobID, err)
-		return nil, fuse.EIO
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.update(); err != nil {
+		n.fs.errorf("Fetching trace (%d, %d) error: %v\n", n.prjID, n.jobID, err)
+		return nil, errorStatus(err)
 	}
+	n.openCount++
+
+	// The trace of a running job keeps growing; bypass the page cache so
+	// that reads past the size the kernel last saw still reach us.
+	return &nodefs.WithFlags{
+		File: &jobTraceFile{
+			File: nodefs.NewDefaultFile(),
+			node: n,
+		},
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
 
-	traceBuf, err := ioutil.ReadAll(traceReader)
-	if err != nil {
-		log.Printf("ReadAll error: %v\n", err)
-		return nil, fuse.EIO
+// jobTraceFile is an open job trace. While the job is active, reads past the
+// end of what has been fetched so far fetch any new output from GitLab.
+type jobTraceFile struct {
+	nodefs.File
+	node *jobTraceNode
+}
+
+func (f *jobTraceFile) String() string {
+	return fmt.Sprintf("jobTraceFile(%d, %d)", f.node.prjID, f.node.jobID)
+}
+
+func (f *jobTraceFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	n := f.node
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if off+int64(len(dest)) > int64(len(n.buf)) {
+		if err := n.update(); err != nil {
+			n.fs.errorf("Fetching trace (%d, %d) error: %v\n", n.prjID, n.jobID, err)
+		}
+	}
+
+	if off >= int64(len(n.buf)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(n.buf)) {
+		end = int64(len(n.buf))
 	}
+	return fuse.ReadResultData(n.buf[off:end]), fuse.OK
+}
+
+func (f *jobTraceFile) GetAttr(out *fuse.Attr) fuse.Status {
+	n := f.node
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = n.size()
+	return fuse.OK
+}
 
-	return nodefs.NewDataFile(traceBuf), fuse.OK
+func (f *jobTraceFile) Release() {
+	n := f.node
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.openCount--
+	if n.openCount == 0 {
+		// Only keep the size, for GetAttr
+		n.lastSize = uint64(len(n.buf))
+		n.buf = nil
+		n.finished = false
+		n.lastFetch = time.Time{}
+	}
 }
 
 /******************************************************************************/
@@ -430,16 +1732,31 @@ func (n *jobTraceNode) Open(flags uint32, context *fuse.Context) (nodefs.File, f
 
 type jobArtifactsArchiveNode struct {
 	jobNode
+
+	mu   sync.Mutex
 	size uint64
 }
 
+// getSize returns the size of the archive, as reported by the job record or
+// seen when it was last downloaded.
+func (n *jobArtifactsArchiveNode) getSize() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.size
+}
+
+func (n *jobArtifactsArchiveNode) setSize(size uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.size = size
+}
+
 func (n *jobArtifactsArchiveNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
-	if file != nil {
-		return file.GetAttr(out)
+	status := n.jobNode.GetAttr(out, file, context)
+	if file == nil {
+		out.Size = n.getSize()
 	}
-	out.Mode = fuse.S_IFREG | 0444
-	out.Size = n.size
-	return fuse.OK
+	return status
 }
 
 func (n *jobArtifactsArchiveNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
@@ -447,20 +1764,30 @@ func (n *jobArtifactsArchiveNode) Open(flags uint32, context *fuse.Context) (nod
 		return nil, fuse.EPERM
 	}
 
-	artReader, _, err := n.fs.client.Jobs.GetJobArtifacts(n.prjID, n.jobID)
+	job, err := n.fs.client.GetJob(n.prjID, n.jobID)
 	if err != nil {
-		log.Printf("GetJobArtifacts(%d, %d) error: %v\n", n.prjID, n.jobID, err)
-		return nil, fuse.EIO
+		n.fs.errorf("GetJob(%d, %d) error: %v\n", n.prjID, n.jobID, err)
+		return nil, errorStatus(err)
+	}
+
+	f, err := n.fs.openArtifactsArchive(n.prjID, n.jobID, !isJobActive(job.Status))
+	if err != nil {
+		return nil, errorStatus(err)
 	}
 
-	artBuf, err := ioutil.ReadAll(artReader)
+	fi, err := f.Stat()
 	if err != nil {
-		log.Printf("ReadAll error: %v\n", err)
+		n.fs.errorf("Stat artifacts archive error: %v\n", err)
+		f.Close()
 		return nil, fuse.EIO
 	}
 
-	n.size = uint64(len(artBuf))
-	return nodefs.NewDataFile(artBuf), fuse.OK
+	if size := uint64(fi.Size()); size != n.getSize() {
+		n.fs.debug.Printf("Artifacts archive of job (%d) is %d bytes, expected %d\n", n.jobID, size, n.getSize())
+		n.setSize(size)
+	}
+
+	return nodefs.NewReadOnlyFile(nodefs.NewLoopbackFile(f)), fuse.OK
 }
 
 /******************************************************************************/
@@ -471,88 +1798,154 @@ type jobArtifactsDirNode struct {
 	fs    *GitlabFs
 	prjID int
 	jobID int
+	job   *jobDirNode
 
-	zipr *ZipFileReader
+	// Held while reading the archive's table of contents
+	mu      sync.Mutex
+	fetched bool
+
+	// A local copy of the whole archive, if it could not be read remotely
+	// using range requests. If nil, files are fetched individually.
+	local ArchiveReader
 }
 
-func NewJobArtifactsDirNode(fs *GitlabFs, prjID, jobID int) *jobArtifactsDirNode {
+func NewJobArtifactsDirNode(job *jobDirNode) *jobArtifactsDirNode {
 	return &jobArtifactsDirNode{
 		Node:  nodefs.NewDefaultNode(),
-		prjID: prjID,
-		jobID: jobID,
-		fs:    fs,
+		prjID: job.jobs.prjID,
+		jobID: job.getJob().ID,
+		fs:    job.jobs.fs,
+		job:   job,
 	}
 }
 
-func (n *jobArtifactsDirNode) getArchive() (*os.File, error) {
-	n.fs.debug.Printf("Getting artifact archive for prjID=%d, jobID=%d\n", n.prjID, n.jobID)
+// mtime returns the time of the artifacts, i.e. of the job.
+func (n *jobArtifactsDirNode) mtime() time.Time {
+	return jobTime(n.job.getJob())
+}
+
+func (n *jobArtifactsDirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mtime())
+}
 
-	// Get its name
-	job, _, err := n.fs.client.Jobs.GetJob(n.prjID, n.jobID)
+// getLocalArchive downloads the whole archive and reads its table of
+// contents from the local copy.
+func (n *jobArtifactsDirNode) getLocalArchive(filename string, cacheable bool) ([]*ArchiveEntry, error) {
+	archf, err := n.fs.openArtifactsArchive(n.prjID, n.jobID, cacheable)
 	if err != nil {
-		log.Printf("GetJob(prjID=%d jobID=%d) failed: %v\n", n.prjID, n.jobID, err)
 		return nil, err
 	}
-	filename := job.ArtifactsFile.Filename
 
-	if !strings.HasSuffix(filename, ".zip") {
-		return nil, errors.New("Only zip files are supported")
-	}
+	return n.readLocalArchive(archf, filename)
+}
 
-	// Download the artifact
-	artReader, _, err := n.fs.client.Jobs.GetJobArtifacts(n.prjID, n.jobID)
-	if err != nil {
-		log.Printf("GetJobArtifacts(prjID=%d jobID=%d) failed: %v\n", n.prjID, n.jobID, err)
-		return nil, err
-	}
+// readLocalArchive reads the table of contents of the archive in archf.
+func (n *jobArtifactsDirNode) readLocalArchive(archf *os.File, filename string) ([]*ArchiveEntry, error) {
+	var err error
 
-	f, err := UnlinkedTempFile("", "gitlab-fuse-artifact")
+	n.local, err = ArchiveReaderFromFile(archf, filename)
 	if err != nil {
-		log.Printf("UnlinkedTempFile() failed: %v\n", err)
+		n.fs.errorf("Reading archive %q failed: %v\n", filename, err)
+		archf.Close()
 		return nil, err
 	}
 
-	_, err = io.Copy(f, artReader)
+	return n.local.Entries(), nil
+}
+
+// getRemoteZipArchive reads only the table of contents (central directory)
+// of a zip archive from the server.
+func (n *jobArtifactsDirNode) getRemoteZipArchive(size int64) ([]*ArchiveEntry, error) {
+	ra := n.fs.client.NewArtifactsReaderAt(n.prjID, n.jobID, size)
+	zipr, err := zip.NewReader(ra, size)
 	if err != nil {
-		log.Printf("Copying artifact archive failed: %v\n", err)
 		return nil, err
 	}
-
-	f.Seek(0, os.SEEK_SET)
-	return f, nil
+	return ZipEntries(zipr), nil
 }
 
-func (n *jobArtifactsDirNode) fetch() bool {
-	if n.zipr != nil {
-		return true
+// fetch reads the table of contents of the archive, if it wasn't read yet.
+func (n *jobArtifactsDirNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.fetched {
+		return nil
 	}
 
-	archf, err := n.getArchive()
+	// Get its name and size
+	job, err := n.fs.client.GetJob(n.prjID, n.jobID)
 	if err != nil {
-		return false
+		n.fs.errorf("GetJob(prjID=%d jobID=%d) failed: %v\n", n.prjID, n.jobID, err)
+		return err
+	}
+	filename := job.ArtifactsFile.Filename
+	cacheable := !isJobActive(job.Status)
+
+	// Use a cached copy of the archive, if there is one
+	var cached *os.File
+	if cache := n.fs.opts.ArtifactCache; cache != nil && cacheable {
+		cached = cache.Get(n.fs.artifactCacheKey(n.prjID, n.jobID))
 	}
 
-	n.zipr, err = ZipReaderFromFile(archf)
+	var entries []*ArchiveEntry
+	switch ArchiveFormat(filename) {
+	case "":
+		n.fs.errorf("Artifacts archive %q (prjID=%d jobID=%d): %v\n",
+			filename, n.prjID, n.jobID, ErrUnsupportedArchive)
+		if cached != nil {
+			cached.Close()
+		}
+		return ErrUnsupportedArchive
+	case "zip":
+		if cached != nil {
+			entries, err = n.readLocalArchive(cached, filename)
+			break
+		}
+		entries, err = n.getRemoteZipArchive(int64(job.ArtifactsFile.Size))
+		if !errors.Is(err, ErrRangeNotSupported) {
+			break
+		}
+		n.fs.debug.Printf("Range requests not supported; downloading whole archive\n")
+		fallthrough
+	default:
+		// Other formats can only be read in full
+		if cached != nil {
+			entries, err = n.readLocalArchive(cached, filename)
+			break
+		}
+		entries, err = n.getLocalArchive(filename, cacheable)
+	}
 	if err != nil {
-		log.Printf("zip.NewReader() failed: %v\n", err)
-		archf.Close()
-		return false
+		n.fs.errorf("Reading artifacts archive (prjID=%d jobID=%d) failed: %v\n", n.prjID, n.jobID, err)
+		return err
 	}
 
-	for _, f := range n.zipr.File {
-		n.addFile(f)
+	for _, e := range entries {
+		n.addFile(e)
 	}
 
-	return true
+	n.fetched = true
+	return nil
+}
+
+// localArchive returns the local copy of the archive, or nil if there is none.
+func (n *jobArtifactsDirNode) localArchive() ArchiveReader {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.local
 }
 
-func (n *jobArtifactsDirNode) addFile(f *zip.File) {
+func (n *jobArtifactsDirNode) addFile(f *ArchiveEntry) {
 	n.fs.debug.Printf("   %q\n", f.Name)
-	comps := strings.Split(f.Name, "/")
+
+	// Directory entries end with a slash
+	comps := strings.Split(strings.TrimSuffix(f.Name, "/"), "/")
+	isDirEntry := strings.HasSuffix(f.Name, "/")
 
 	node := n.Inode()
 	for i, c := range comps {
-		isFile := i == len(comps)-1
+		isFile := i == len(comps)-1 && !isDirEntry
 
 		// Does this node exist?
 		child := node.GetChild(c)
@@ -560,6 +1953,7 @@ func (n *jobArtifactsDirNode) addFile(f *zip.File) {
 			// Create it
 			fsnode := &jobArtifactNode{
 				Node: nodefs.NewDefaultNode(),
+				dir:  n,
 			}
 			if isFile {
 				fsnode.f = f
@@ -574,8 +1968,8 @@ func (n *jobArtifactsDirNode) addFile(f *zip.File) {
 func (n *jobArtifactsDirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	n.fs.debug.Printf("jobArtifactsDirNode.OpenDir() (prjID=%d jobID=%d)\n", n.prjID, n.jobID)
 
-	if !n.fetch() {
-		return nil, fuse.EIO
+	if err := n.fetch(); err != nil {
+		return nil, errorStatus(err)
 	}
 
 	return n.Node.OpenDir(context)
@@ -584,8 +1978,8 @@ func (n *jobArtifactsDirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, f
 func (n *jobArtifactsDirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	n.fs.debug.Printf("jobArtifactsDirNode.Lookup(%q) (prjID=%d jobID=%d)\n", name, n.prjID, n.jobID)
 
-	if !n.fetch() {
-		return nil, fuse.EIO
+	if err := n.fetch(); err != nil {
+		return nil, errorStatus(err)
 	}
 	ch := n.Inode().GetChild(name)
 	if ch == nil {
@@ -599,10 +1993,17 @@ func (n *jobArtifactsDirNode) Lookup(out *fuse.Attr, name string, context *fuse.
 
 type jobArtifactNode struct {
 	nodefs.Node
-	f *zip.File
+	dir *jobArtifactsDirNode
+	f   *ArchiveEntry
 }
 
 func (n *jobArtifactNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	mtime := n.dir.mtime()
+	if n.f != nil && !n.f.ModTime.IsZero() {
+		mtime = n.f.ModTime
+	}
+	defer setTimes(out, mtime)
+
 	if file != nil {
 		return file.GetAttr(out)
 	}
@@ -610,10 +2011,8 @@ func (n *jobArtifactNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fus
 		out.Mode = fuse.S_IFDIR | 0555
 		return fuse.OK
 	}
-	t := ConvertDosDateTime(n.f.ModifiedDate, n.f.ModifiedTime)
 	out.Mode = fuse.S_IFREG | 0444
-	out.Size = n.f.UncompressedSize64
-	out.Mtime = uint64(t.Unix())
+	out.Size = n.f.Size
 	return fuse.OK
 }
 
@@ -622,17 +2021,28 @@ func (n *jobArtifactNode) Open(flags uint32, context *fuse.Context) (nodefs.File
 		return nil, fuse.EPERM
 	}
 
-	// Open the file from the zip archive
+	if n.dir.localArchive() == nil {
+		// Fetch just this file from the server
+		buf, err := n.dir.fs.client.GetSingleArtifactsFile(n.dir.prjID, n.dir.jobID, n.f.Name)
+		if err != nil {
+			n.dir.fs.errorf("GetSingleArtifactsFile(%d, %d, %q) failed: %v\n",
+				n.dir.prjID, n.dir.jobID, n.f.Name, err)
+			return nil, errorStatus(err)
+		}
+		return nodefs.NewDataFile(buf), fuse.OK
+	}
+
+	// Open the file from the local archive
 	rc, err := n.f.Open()
 	if err != nil {
-		log.Printf("zip.File.Open() failed: %v\n", err)
+		n.dir.fs.errorf("Opening %q from archive failed: %v\n", n.f.Name, err)
 		return nil, fuse.EIO
 	}
 	defer rc.Close()
 
 	buf, err := ioutil.ReadAll(rc)
 	if err != nil {
-		log.Printf("ReadAll error: %v\n", err)
+		n.dir.fs.errorf("ReadAll error: %v\n", err)
 		return nil, fuse.EIO
 	}
 
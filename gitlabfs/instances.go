@@ -0,0 +1,229 @@
+package gitlabfs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+/**
+ * When several GitLab instances are mounted together, the root holds one
+ * directory per instance:
+ * <mountpoint>/
+ *     gitlab.com/
+ *         <namespace>/...
+ *     git.corp/
+ *         <namespace>/...
+ *
+ * Each instance is a GitlabFs of its own, with its own client, credentials,
+ * options and caches. An instance which cannot be reached only makes its own
+ * directory fail.
+ *
+ * Besides the .gitlabfs directory of each instance, the root holds one
+ * covering all of them.
+ */
+
+type MultiFs struct {
+	root      *multiRootNode
+	instances map[string]*GitlabFs
+
+	// When the filesystem was created, the time of .gitlabfs
+	started sharedTime
+
+	// The latest errors not specific to an instance
+	errors errorLog
+}
+
+// NewMultiFs creates a filesystem holding each of the given instances in the
+// directory of the same name.
+func NewMultiFs(instances map[string]*GitlabFs) *MultiFs {
+	m := &MultiFs{
+		instances: instances,
+	}
+	m.root = &multiRootNode{
+		Node: nodefs.NewDefaultNode(),
+		m:    m,
+	}
+
+	now := time.Now()
+	m.started.update(&now)
+
+	return m
+}
+
+func (m *MultiFs) Root() nodefs.Node {
+	return m.root
+}
+
+// ResyncJobs calls ResyncJobs on every instance.
+func (m *MultiFs) ResyncJobs() {
+	for _, fs := range m.instances {
+		fs.ResyncJobs()
+	}
+}
+
+// Refresh calls Refresh on every instance.
+func (m *MultiFs) Refresh() {
+	for _, fs := range m.instances {
+		fs.Refresh()
+	}
+}
+
+/******************************************************************************/
+/* multiRootNode */
+
+type multiRootNode struct {
+	nodefs.Node
+	m *MultiFs
+}
+
+func (r *multiRootNode) OnMount(c *nodefs.FileSystemConnector) {
+	for name, fs := range r.m.instances {
+		r.Inode().NewChild(name, true, fs.root)
+		fs.root.OnMount(c)
+	}
+	r.m.addControlDir()
+}
+
+func (r *multiRootNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	return nil, fuse.ENOENT
+}
+
+/******************************************************************************/
+/* .gitlabfs */
+
+// addControlDir adds a .gitlabfs directory to the root, like the one of each
+// instance, but covering all of them:
+//   - errors, stats and config hold those of every instance, marked with its
+//     name
+//   - The commands written to ctl are run by every instance, except for
+//     "refresh <path>", which is run by the instance whose directory path is in
+func (m *MultiFs) addControlDir() {
+	if m.root.Inode().GetChild(".gitlabfs") != nil {
+		return
+	}
+
+	dir := m.root.Inode().NewChild(".gitlabfs", true, NewDirNode(&m.started))
+	dir.NewChild("errors", false, &errorLogNode{
+		Node: nodefs.NewDefaultNode(),
+		data: m.errorData,
+	})
+	dir.NewChild("stats", false, &generatedFileNode{
+		Node:     nodefs.NewDefaultNode(),
+		generate: m.statsText,
+	})
+	dir.NewChild("version", false, NewStaticFileNode(versionText(), m.started.get()))
+	dir.NewChild("config", false, &generatedFileNode{
+		Node:     nodefs.NewDefaultNode(),
+		generate: m.configText,
+	})
+	dir.NewChild("ctl", false, &controlCtlNode{
+		Node:  nodefs.NewDefaultNode(),
+		run:   m.runCommand,
+		mtime: &m.started,
+	})
+}
+
+// names returns the names of the instances, sorted.
+func (m *MultiFs) names() []string {
+	names := make([]string, 0, len(m.instances))
+	for name := range m.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errorData returns the latest errors of all instances, oldest first, each
+// with the name of its instance after the time. Those of artifact caches
+// (which may be shared by instances) are included once, unmarked.
+func (m *MultiFs) errorData() ([]byte, time.Time) {
+	lines, mtime := m.errors.get()
+	caches := make(map[*ArtifactCache]bool)
+	for _, name := range m.names() {
+		fs := m.instances[name]
+		instLines, t := fs.errors.get()
+		for _, line := range instLines {
+			when, msg := splitErrorLine(line)
+			lines = append(lines, when+" "+name+": "+msg)
+		}
+		if t.After(mtime) {
+			mtime = t
+		}
+
+		if cache := fs.opts.ArtifactCache; cache != nil && !caches[cache] {
+			caches[cache] = true
+			cacheLines, t := cache.errors.get()
+			lines = append(lines, cacheLines...)
+			if t.After(mtime) {
+				mtime = t
+			}
+		}
+	}
+
+	lines = sortErrorLines(lines)
+	return []byte(strings.Join(lines, "")), mtime
+}
+
+func (m *MultiFs) statsText() string {
+	var b strings.Builder
+	for i, name := range m.names() {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "# %s\n", name)
+		b.WriteString(m.instances[name].statsText())
+	}
+	return b.String()
+}
+
+// configText returns the options of each instance, in a profile named after
+// its directory.
+func (m *MultiFs) configText() string {
+	var b strings.Builder
+	for i, name := range m.names() {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[profiles.%s]\n", strconv.Quote(name))
+		b.WriteString(m.instances[name].configText())
+	}
+	return b.String()
+}
+
+// runCommand runs a single command written to the root's .gitlabfs/ctl.
+func (m *MultiFs) runCommand(line string) fuse.Status {
+	cmd, arg := splitCommand(line)
+
+	if cmd == "refresh" && arg != "" {
+		// The path starts with the directory of an instance, unless it is
+		// the root
+		p := strings.Trim(path.Clean("/"+arg), "/")
+		if p != "" {
+			name, rest := p, "."
+			if i := strings.IndexByte(p, '/'); i >= 0 {
+				name, rest = p[:i], p[i+1:]
+			}
+			fs := m.instances[name]
+			if fs == nil {
+				m.errors.logf("ctl: refresh: %q not found\n", arg)
+				return fuse.ENOENT
+			}
+			return fs.runCommand("refresh " + rest)
+		}
+		line = "refresh ."
+	}
+
+	for _, name := range m.names() {
+		if status := m.instances[name].runCommand(line); !status.Ok() {
+			return status
+		}
+	}
+	return fuse.OK
+}
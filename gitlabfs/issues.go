@@ -0,0 +1,338 @@
+package gitlabfs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Issue paths are composed like this:
+ * <project>/
+ *     issues/
+ *         <iid>/
+ *             title
+ *             description.md
+ *             state
+ *             labels               One per line
+ *             assignees            One username per line
+ *             milestone
+ *             notes/
+ *                 <note_id>.md
+ *         open/
+ *             <iid> -> ../<iid>
+ *         closed/
+ *             <iid> -> ../<iid>
+ */
+
+/******************************************************************************/
+/* <project>/issues/ */
+
+type projectIssuesNode struct {
+	nodefs.Node
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *projectIssuesNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *projectIssuesNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("projectIssuesNode.fetch() sinceLastUpdate=%v\n", sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinIssuesDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	// Get all of the issues from the API
+	issues, err := n.fs.client.GetAllProjectIssues(n.prjID)
+	if err != nil {
+		n.fs.errorf("GetAllProjectIssues(%d) error: %v\n", n.prjID, err)
+		return err
+	}
+
+	// Get (or create) the state views
+	views := make(map[string]*nodefs.Inode)
+	for _, state := range []string{"opened", "closed"} {
+		name := n.viewName(state)
+		views[state] = n.Inode().GetChild(name)
+		if views[state] == nil {
+			views[state] = n.Inode().NewChild(name, true, NewDirNode(n.activity))
+		}
+	}
+
+	listed := make(map[string]bool)
+	for _, issue := range issues {
+		name := strconv.Itoa(issue.IID)
+		listed[name] = true
+
+		ch := n.Inode().GetChild(name)
+		if ch == nil {
+			n.addNewIssueDirNode(issue)
+		} else if issueNode, ok := ch.Node().(*issueNode); ok {
+			// Update the existing one
+			issueNode.setIssue(issue)
+		}
+
+		// Keep the state views up to date
+		for state, view := range views {
+			if issue.State == state {
+				n.fs.setSymlink(view, name, "../"+name)
+			} else {
+				n.fs.removeChild(view, name)
+			}
+		}
+	}
+
+	// Remove issues which no longer exist (e.g. deleted ones, or ones moved
+	// to another project), and their links
+	for name, ch := range n.Inode().Children() {
+		if _, ok := ch.Node().(*issueNode); ok && !listed[name] {
+			n.fs.debug.Printf("Removing issue inode (%s) from project (%d)\n", name, n.prjID)
+			n.fs.removeChild(n.Inode(), name)
+		}
+	}
+	for _, view := range views {
+		for name := range view.Children() {
+			if !listed[name] {
+				n.fs.removeChild(view, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// viewName returns the name of the directory of symlinks to issues in the
+// given state.
+func (n *projectIssuesNode) viewName(state string) string {
+	if state == "opened" {
+		return "open"
+	}
+	return state
+}
+
+func (n *projectIssuesNode) addNewIssueDirNode(issue *gitlab.Issue) {
+	n.fs.debug.Printf("Adding new issue inode (%d) to project (%d)\n", issue.IID, n.prjID)
+
+	issueNode := &issueNode{
+		Node:  nodefs.NewDefaultNode(),
+		fs:    n.fs,
+		prjID: n.prjID,
+		iid:   issue.IID,
+		issue: issue,
+	}
+
+	// Add the issues/12 directory
+	dirInode := n.Inode().NewChild(strconv.Itoa(issue.IID), true, issueNode)
+
+	// Add the issues/12/xxx files
+	attrs := map[string]func(*gitlab.Issue) string{
+		"title":          func(issue *gitlab.Issue) string { return issue.Title },
+		"description.md": func(issue *gitlab.Issue) string { return issue.Description },
+		"state":          func(issue *gitlab.Issue) string { return issue.State },
+		"labels":         func(issue *gitlab.Issue) string { return strings.Join(issue.Labels, "\n") },
+		"assignees": func(issue *gitlab.Issue) string {
+			var names []string
+			for _, a := range issue.Assignees {
+				names = append(names, a.Username)
+			}
+			return strings.Join(names, "\n")
+		},
+		"milestone": func(issue *gitlab.Issue) string {
+			if issue.Milestone == nil {
+				return ""
+			}
+			return issue.Milestone.Title
+		},
+	}
+	for name, get := range attrs {
+		get := get
+		dirInode.NewChild(name, false, &attrFileNode{
+			Node:  nodefs.NewDefaultNode(),
+			get:   func() string { return get(issueNode.getIssue()) },
+			mtime: issueNode.mtime,
+		})
+	}
+
+	dirInode.NewChild("notes", true, &issueNotesNode{
+		Node:  nodefs.NewDefaultNode(),
+		issue: issueNode,
+	})
+}
+
+func (n *projectIssuesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *projectIssuesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("projectIssuesNode.OpenDir(%d)\n", n.prjID)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *projectIssuesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("projectIssuesNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* issues/<iid>/ */
+
+type issueNode struct {
+	nodefs.Node
+	fs    *GitlabFs
+	prjID int
+	iid   int
+
+	mu    sync.Mutex
+	issue *gitlab.Issue
+}
+
+// getIssue returns the most recently fetched issue record.
+func (n *issueNode) getIssue() *gitlab.Issue {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.issue
+}
+
+// setIssue stores the latest issue record.
+func (n *issueNode) setIssue(issue *gitlab.Issue) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.issue = issue
+}
+
+// mtime returns the time the issue was last updated.
+func (n *issueNode) mtime() time.Time {
+	return timeOf(n.getIssue().UpdatedAt)
+}
+
+func (n *issueNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mtime())
+}
+
+/******************************************************************************/
+/* issues/<iid>/notes/ */
+
+type issueNotesNode struct {
+	nodefs.Node
+	issue *issueNode
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *issueNotesNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *issueNotesNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fs := n.issue.fs
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	fs.debug.Printf("issueNotesNode.fetch(%d) sinceLastUpdate=%v\n", n.issue.iid, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < fs.opts.MinIssuesDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	notes, err := fs.client.GetAllIssueNotes(n.issue.prjID, n.issue.iid)
+	if err != nil {
+		n.issue.fs.errorf("GetAllIssueNotes(%d, %d) error: %v\n", n.issue.prjID, n.issue.iid, err)
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, note := range notes {
+		if note.System {
+			continue
+		}
+		name := strconv.Itoa(note.ID) + ".md"
+		listed[name] = true
+		fs.setStaticFile(n.Inode(), name, formatNote(note), timeOf(note.UpdatedAt))
+	}
+
+	// Remove notes which were deleted
+	for name := range n.Inode().Children() {
+		if !listed[name] {
+			fs.removeChild(n.Inode(), name)
+		}
+	}
+
+	return nil
+}
+
+func (n *issueNotesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.issue.mtime())
+}
+
+func (n *issueNotesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.issue.fs.debug.Printf("issueNotesNode.OpenDir(%d, %d)\n", n.issue.prjID, n.issue.iid)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *issueNotesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.issue.fs.debug.Printf("issueNotesNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
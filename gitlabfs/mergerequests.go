@@ -0,0 +1,649 @@
+package gitlabfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Merge request paths are composed like this:
+ * <project>/
+ *     merge_requests/
+ *         <iid>/
+ *             title
+ *             description
+ *             state
+ *             author
+ *             source_branch
+ *             target_branch
+ *             diff                 Unified patch of all changes
+ *             changes/
+ *                 <path>           Patch of a single file
+ *             discussions/
+ *                 <discussion_id>.md
+ *             pipeline -> ../../pipelines/<pipeline_id>   (if pipelines/ exists)
+ */
+
+/******************************************************************************/
+/* <project>/merge_requests/ */
+
+type projectMergeRequestsNode struct {
+	nodefs.Node
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *projectMergeRequestsNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *projectMergeRequestsNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("projectMergeRequestsNode.fetch() sinceLastUpdate=%v\n", sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinMergeRequestsDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	// Get all of the merge requests from the API
+	mrs, err := n.fs.client.GetAllProjectMergeRequests(n.prjID)
+	if err != nil {
+		n.fs.errorf("GetAllProjectMergeRequests(%d) error: %v\n", n.prjID, err)
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, mr := range mrs {
+		name := strconv.Itoa(mr.IID)
+		listed[name] = true
+
+		ch := n.Inode().GetChild(name)
+		if ch == nil {
+			n.addNewMergeRequestDirNode(mr)
+			continue
+		}
+
+		// Update the existing one
+		if mrNode, ok := ch.Node().(*mergeRequestNode); ok {
+			mrNode.setMergeRequest(mr)
+		}
+	}
+
+	// Remove merge requests which no longer exist
+	for name, ch := range n.Inode().Children() {
+		if _, ok := ch.Node().(*mergeRequestNode); ok && !listed[name] {
+			n.fs.debug.Printf("Removing merge request inode (%s) from project (%d)\n", name, n.prjID)
+			n.fs.removeChild(n.Inode(), name)
+		}
+	}
+
+	return nil
+}
+
+func (n *projectMergeRequestsNode) addNewMergeRequestDirNode(mr *gitlab.MergeRequest) {
+	n.fs.debug.Printf("Adding new merge request inode (%d) to project (%d)\n", mr.IID, n.prjID)
+
+	mrNode := &mergeRequestNode{
+		Node:  nodefs.NewDefaultNode(),
+		fs:    n.fs,
+		prjID: n.prjID,
+		iid:   mr.IID,
+	}
+
+	// Add the merge_requests/12 directory
+	dirInode := n.Inode().NewChild(strconv.Itoa(mr.IID), true, mrNode)
+
+	// Add the merge_requests/12/xxx files
+	attrs := map[string]func(*gitlab.MergeRequest) string{
+		"title":       func(mr *gitlab.MergeRequest) string { return mr.Title },
+		"description": func(mr *gitlab.MergeRequest) string { return mr.Description },
+		"state":       func(mr *gitlab.MergeRequest) string { return mr.State },
+		"author": func(mr *gitlab.MergeRequest) string {
+			if mr.Author == nil {
+				return ""
+			}
+			return mr.Author.Username
+		},
+		"source_branch": func(mr *gitlab.MergeRequest) string { return mr.SourceBranch },
+		"target_branch": func(mr *gitlab.MergeRequest) string { return mr.TargetBranch },
+	}
+	for name, get := range attrs {
+		get := get
+		dirInode.NewChild(name, false, &attrFileNode{
+			Node:  nodefs.NewDefaultNode(),
+			get:   func() string { return get(mrNode.mergeRequest()) },
+			mtime: mrNode.mtime,
+		})
+	}
+
+	dirInode.NewChild("diff", false, &mergeRequestDiffNode{
+		Node: nodefs.NewDefaultNode(),
+		mr:   mrNode,
+	})
+	dirInode.NewChild("changes", true, &mergeRequestChangesNode{
+		Node: nodefs.NewDefaultNode(),
+		mr:   mrNode,
+	})
+	dirInode.NewChild("discussions", true, &mergeRequestDiscussionsNode{
+		Node: nodefs.NewDefaultNode(),
+		mr:   mrNode,
+	})
+
+	mrNode.setMergeRequest(mr)
+}
+
+func (n *projectMergeRequestsNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *projectMergeRequestsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("projectMergeRequestsNode.OpenDir(%d)\n", n.prjID)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *projectMergeRequestsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("projectMergeRequestsNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* merge_requests/<iid>/ */
+
+type mergeRequestNode struct {
+	nodefs.Node
+	fs    *GitlabFs
+	prjID int
+	iid   int
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+
+	// Protects mr, which is also set when the parent directory is updated
+	mrMu sync.Mutex
+	mr   *gitlab.MergeRequest
+}
+
+// mergeRequest returns the most recently fetched merge request record.
+func (n *mergeRequestNode) mergeRequest() *gitlab.MergeRequest {
+	n.mrMu.Lock()
+	defer n.mrMu.Unlock()
+	return n.mr
+}
+
+// setMergeRequest stores the latest merge request record, and updates the
+// pipeline symlink to match it. There is no symlink if the project has no
+// pipelines/ directory for it to point into.
+func (n *mergeRequestNode) setMergeRequest(mr *gitlab.MergeRequest) {
+	n.mrMu.Lock()
+	defer n.mrMu.Unlock()
+
+	n.mr = mr
+
+	pipelineID := 0
+	if mr.HeadPipeline != nil {
+		pipelineID = mr.HeadPipeline.ID
+	} else if mr.Pipeline != nil {
+		pipelineID = mr.Pipeline.ID
+	}
+
+	if pipelineID == 0 || !n.hasPipelinesDir() {
+		n.fs.removeChild(n.Inode(), "pipeline")
+		return
+	}
+	n.fs.setSymlink(n.Inode(), "pipeline", "../../pipelines/"+strconv.Itoa(pipelineID))
+}
+
+// hasPipelinesDir returns true if the project holding the merge request has a
+// pipelines/ directory, i.e. its jobs are enabled, and so is the subtree.
+func (n *mergeRequestNode) hasPipelinesDir() bool {
+	mrsInode, _ := n.Inode().Parent()
+	if mrsInode == nil {
+		return false
+	}
+	prjInode, _ := mrsInode.Parent()
+	return prjInode != nil && prjInode.GetChild("pipelines") != nil
+}
+
+// mtime returns the time the merge request was last updated.
+func (n *mergeRequestNode) mtime() time.Time {
+	mr := n.mergeRequest()
+	if mr == nil {
+		return time.Time{}
+	}
+	return timeOf(mr.UpdatedAt)
+}
+
+func (n *mergeRequestNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mtime())
+}
+
+func (n *mergeRequestNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *mergeRequestNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("mergeRequestNode.fetch(%d) sinceLastUpdate=%v\n", n.iid, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinMergeRequestsDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	// The single merge request includes its head pipeline, which the
+	// listing does not
+	mr, err := n.fs.client.GetMergeRequest(n.prjID, n.iid)
+	if err != nil {
+		n.fs.errorf("GetMergeRequest(%d, %d) error: %v\n", n.prjID, n.iid, err)
+		return err
+	}
+	n.setMergeRequest(mr)
+
+	return nil
+}
+
+func (n *mergeRequestNode) getChanges() (*gitlab.MergeRequest, error) {
+	mr, _, err := n.fs.client.MergeRequests.GetMergeRequestChanges(n.prjID, n.iid, nil)
+	if err != nil {
+		n.fs.errorf("GetMergeRequestChanges(%d, %d) error: %v\n", n.prjID, n.iid, err)
+	}
+	return mr, err
+}
+
+func (n *mergeRequestNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("mergeRequestNode.OpenDir(%d, %d)\n", n.prjID, n.iid)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *mergeRequestNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("mergeRequestNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* merge_requests/<iid>/diff */
+
+// formatChange formats a single merge request change as a git-style patch.
+func formatChange(oldPath, newPath, aMode, bMode, diff string, newFile, renamedFile, deletedFile bool) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", oldPath, newPath)
+
+	from, to := "a/"+oldPath, "b/"+newPath
+	switch {
+	case newFile:
+		fmt.Fprintf(&b, "new file mode %s\n", bMode)
+		from = "/dev/null"
+	case deletedFile:
+		fmt.Fprintf(&b, "deleted file mode %s\n", aMode)
+		to = "/dev/null"
+	case aMode != bMode:
+		fmt.Fprintf(&b, "old mode %s\nnew mode %s\n", aMode, bMode)
+	}
+	if renamedFile {
+		fmt.Fprintf(&b, "rename from %s\nrename to %s\n", oldPath, newPath)
+	}
+
+	if diff != "" {
+		fmt.Fprintf(&b, "--- %s\n+++ %s\n", from, to)
+		b.WriteString(diff)
+		if !strings.HasSuffix(diff, "\n") {
+			b.WriteString("\n")
+		}
+	}
+
+	return b.String()
+}
+
+// mergeRequestDiffNode is the unified patch of all changes, fetched whenever
+// the file is opened. Its size is that of the most recently fetched patch, 0
+// before the first open, so a stat never needs to ask GitLab; the contents
+// are served bypassing the page cache.
+type mergeRequestDiffNode struct {
+	nodefs.Node
+	mr *mergeRequestNode
+
+	// The size of the most recently fetched patch
+	mu   sync.Mutex
+	size uint64
+}
+
+func (n *mergeRequestDiffNode) getDiff() ([]byte, error) {
+	mr, err := n.mr.getChanges()
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	for _, c := range mr.Changes {
+		b.WriteString(formatChange(c.OldPath, c.NewPath, c.AMode, c.BMode, c.Diff,
+			c.NewFile, c.RenamedFile, c.DeletedFile))
+	}
+
+	n.mu.Lock()
+	n.size = uint64(b.Len())
+	n.mu.Unlock()
+	return []byte(b.String()), nil
+}
+
+func (n *mergeRequestDiffNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, n.mr.mtime())
+	if file != nil {
+		return file.GetAttr(out)
+	}
+	out.Mode = fuse.S_IFREG | 0444
+	n.mu.Lock()
+	out.Size = n.size
+	n.mu.Unlock()
+	return fuse.OK
+}
+
+func (n *mergeRequestDiffNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+
+	data, err := n.getDiff()
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return newVolatileDataFile(data), fuse.OK
+}
+
+/******************************************************************************/
+/* merge_requests/<iid>/changes/ */
+
+type mergeRequestChangesNode struct {
+	nodefs.Node
+	mr      *mergeRequestNode
+	headSHA string
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *mergeRequestChangesNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *mergeRequestChangesNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fs := n.mr.fs
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	fs.debug.Printf("mergeRequestChangesNode.fetch(%d) sinceLastUpdate=%v\n", n.mr.iid, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < fs.opts.MinMergeRequestsDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	mr, err := n.mr.getChanges()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do if no new commits were pushed
+	if n.headSHA != "" && mr.DiffRefs.HeadSha == n.headSHA {
+		return nil
+	}
+	n.headSHA = mr.DiffRefs.HeadSha
+
+	// Rebuild the tree, timestamped with the merge request's update
+	mtime := newSharedTime(mr.UpdatedAt)
+	for name := range n.Inode().Children() {
+		fs.removeChild(n.Inode(), name)
+	}
+	for _, c := range mr.Changes {
+		path := c.NewPath
+		if c.DeletedFile {
+			path = c.OldPath
+		}
+		patch := formatChange(c.OldPath, c.NewPath, c.AMode, c.BMode, c.Diff,
+			c.NewFile, c.RenamedFile, c.DeletedFile)
+
+		comps := strings.Split(path, "/")
+		node := n.Inode()
+		for _, comp := range comps[:len(comps)-1] {
+			child := node.GetChild(comp)
+			if child == nil {
+				child = node.NewChild(comp, true, NewDirNode(mtime))
+			}
+			node = child
+		}
+		node.NewChild(comps[len(comps)-1], false, NewStaticFileNode(patch, mtime.get()))
+	}
+
+	return nil
+}
+
+func (n *mergeRequestChangesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mr.mtime())
+}
+
+func (n *mergeRequestChangesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.mr.fs.debug.Printf("mergeRequestChangesNode.OpenDir(%d, %d)\n", n.mr.prjID, n.mr.iid)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *mergeRequestChangesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.mr.fs.debug.Printf("mergeRequestChangesNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* merge_requests/<iid>/discussions/ */
+
+// formatNote formats a single note (comment) as markdown.
+func formatNote(note *gitlab.Note) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "**%s** (@%s)", note.Author.Name, note.Author.Username)
+	if note.CreatedAt != nil {
+		fmt.Fprintf(&b, " %s", note.CreatedAt.Format(time.RFC3339))
+	}
+	if note.Position != nil && note.Position.NewPath != "" {
+		fmt.Fprintf(&b, " on `%s`", note.Position.NewPath)
+	}
+	fmt.Fprintf(&b, ":\n\n%s\n", note.Body)
+
+	return b.String()
+}
+
+// formatDiscussion formats a discussion thread as markdown. It returns "" for
+// discussions consisting only of system notes.
+func formatDiscussion(d *gitlab.Discussion) string {
+	var b strings.Builder
+
+	for _, note := range d.Notes {
+		if note.System {
+			continue
+		}
+		if b.Len() != 0 {
+			b.WriteString("\n---\n\n")
+		}
+		b.WriteString(formatNote(note))
+	}
+
+	return b.String()
+}
+
+// discussionTime returns the time the last note of a discussion was updated.
+func discussionTime(d *gitlab.Discussion) time.Time {
+	var t time.Time
+	for _, note := range d.Notes {
+		if nt := timeOf(note.UpdatedAt); nt.After(t) {
+			t = nt
+		}
+	}
+	return t
+}
+
+type mergeRequestDiscussionsNode struct {
+	nodefs.Node
+	mr *mergeRequestNode
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *mergeRequestDiscussionsNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *mergeRequestDiscussionsNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fs := n.mr.fs
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	fs.debug.Printf("mergeRequestDiscussionsNode.fetch(%d) sinceLastUpdate=%v\n", n.mr.iid, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < fs.opts.MinMergeRequestsDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	discussions, err := fs.client.GetAllMergeRequestDiscussions(n.mr.prjID, n.mr.iid)
+	if err != nil {
+		n.mr.fs.errorf("GetAllMergeRequestDiscussions(%d, %d) error: %v\n", n.mr.prjID, n.mr.iid, err)
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, d := range discussions {
+		text := formatDiscussion(d)
+		if text == "" {
+			continue
+		}
+		listed[d.ID+".md"] = true
+		fs.setStaticFile(n.Inode(), d.ID+".md", text, discussionTime(d))
+	}
+
+	// Remove discussions whose notes were all deleted
+	for name := range n.Inode().Children() {
+		if !listed[name] {
+			fs.removeChild(n.Inode(), name)
+		}
+	}
+
+	return nil
+}
+
+func (n *mergeRequestDiscussionsNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mr.mtime())
+}
+
+func (n *mergeRequestDiscussionsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.mr.fs.debug.Printf("mergeRequestDiscussionsNode.OpenDir(%d, %d)\n", n.mr.prjID, n.mr.iid)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *mergeRequestDiscussionsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.mr.fs.debug.Printf("mergeRequestDiscussionsNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
@@ -0,0 +1,403 @@
+package gitlabfs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Namespaces (groups and users) and their projects are discovered lazily:
+ * - Looking up a name asks GitLab for just that project or subgroup, so a
+ *   path like group/project can be used without listing anything else.
+ * - Listing the root lists the top-level groups and the user's own
+ *   namespace, without their projects (unless Options.Groups is set, when
+ *   the projects of those groups are listed).
+ * - Listing a namespace lists all of its projects (and those of its
+ *   subgroups) which pass the filters in Options.
+ * Listings are made at most every MinNamespaceDirUpdateDelay. Projects and
+ * namespaces which are no longer listed are removed.
+ */
+
+type namespaceNode struct {
+	nodefs.Node
+	fs *GitlabFs
+
+	// Full path of the namespace, e.g. "group/subgroup", or "" for the root
+	path string
+
+	// "group" or "user", or "" for the root
+	kind string
+
+	// The latest activity of the projects in it
+	activity sharedTime
+
+	// Held while listing
+	listMu sync.Mutex
+
+	// Held while changing the children, but not while waiting for GitLab,
+	// so that lookups aren't held up by a listing
+	mu         sync.Mutex
+	lastUpdate time.Time
+
+	// Names which were looked up, but don't exist
+	misses map[string]time.Time
+}
+
+func NewNamespaceNode(fs *GitlabFs, path, kind string) *namespaceNode {
+	return &namespaceNode{
+		Node: nodefs.NewDefaultNode(),
+		fs:   fs,
+		path: path,
+		kind: kind,
+	}
+}
+
+// childPath returns the full path of the project or namespace called name in
+// the namespace.
+func (n *namespaceNode) childPath(name string) string {
+	if n.path == "" {
+		return name
+	}
+	return n.path + "/" + name
+}
+
+func (n *namespaceNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+	n.misses = nil
+}
+
+// due returns true if it is time to list the namespace again, taking it as
+// listed now.
+func (n *namespaceNode) due() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("namespaceNode.fetch(%q) sinceLastUpdate=%v\n", n.path, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinNamespaceDirUpdateDelay {
+		// Not time yet
+		return false
+	}
+	n.lastUpdate = time.Now()
+	return true
+}
+
+func (n *namespaceNode) fetch() error {
+	n.listMu.Lock()
+	defer n.listMu.Unlock()
+
+	if !n.due() {
+		return nil
+	}
+
+	if n.path == "" && len(n.fs.opts.Groups) == 0 {
+		return n.fetchNamespaces()
+	}
+
+	prjmap, err := n.fs.listProjects(n.path, n.kind)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err != nil {
+		n.fs.errorf("Listing projects of namespace %q error: %v\n", n.path, err)
+
+		// Don't leave the namespace empty until the next update is due
+		n.lastUpdate = time.Time{}
+		return err
+	}
+
+	// The full paths of the listed projects, and of the namespaces holding
+	// them
+	listed := make(map[string]bool)
+	for ns, projects := range prjmap {
+		for _, prj := range projects {
+			if !n.fs.opts.showProject(prj.PathWithNamespace) {
+				continue
+			}
+			n.fs.addProject(prj)
+
+			listed[prj.PathWithNamespace] = true
+			for p := ns; p != ""; p = parentPath(p) {
+				listed[p] = true
+			}
+		}
+	}
+	n.sync(listed, n.lastUpdate)
+
+	return nil
+}
+
+// fetchNamespaces lists the namespaces in the root, and removes the groups
+// which are no longer listed. Other users' namespaces are never listed, so
+// the ones which were looked up are kept. n.listMu must be held.
+func (n *namespaceNode) fetchNamespaces() error {
+	namespaces, err := n.fs.listRootNamespaces()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err != nil {
+		n.fs.errorf("Listing namespaces error: %v\n", err)
+
+		// Don't leave the root empty until the next update is due
+		n.lastUpdate = time.Time{}
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, ns := range namespaces {
+		n.fs.getNamespaceInode(ns.FullPath, ns.Kind)
+		listed[ns.FullPath] = true
+	}
+
+	n.misses = nil
+	for name, ch := range n.Inode().Children() {
+		if ns, ok := ch.Node().(*namespaceNode); ok && ns.kind == "group" && !listed[ns.path] {
+			n.fs.debug.Printf("Removing namespace %q\n", ns.path)
+			n.fs.removeChild(n.Inode(), name)
+		}
+	}
+
+	return nil
+}
+
+// parentPath returns the full path of the parent of a namespace, or "".
+func parentPath(fullPath string) string {
+	if i := strings.LastIndexByte(fullPath, '/'); i >= 0 {
+		return fullPath[:i]
+	}
+	return ""
+}
+
+// sync removes the projects and namespaces in the namespace which were not
+// listed. The namespaces below it are synced as well, and count as updated,
+// since their projects were part of the listing. n.mu must be held.
+func (n *namespaceNode) sync(listed map[string]bool, t time.Time) {
+	n.misses = nil
+
+	for name, ch := range n.Inode().Children() {
+		switch ns := ch.Node().(type) {
+		case *projectNode:
+			if !listed[n.childPath(name)] {
+				n.fs.debug.Printf("Removing project %q\n", n.childPath(name))
+				n.fs.removeChild(n.Inode(), name)
+			}
+		case *namespaceNode:
+			if !listed[ns.path] {
+				n.fs.debug.Printf("Removing namespace %q\n", ns.path)
+				n.fs.removeChild(n.Inode(), name)
+				continue
+			}
+
+			ns.mu.Lock()
+			if ns.lastUpdate.Before(t) {
+				ns.lastUpdate = t
+			}
+			ns.sync(listed, t)
+			ns.mu.Unlock()
+		}
+	}
+}
+
+// lookup finds a single project or namespace in the namespace, without
+// listing the others.
+func (n *namespaceNode) lookup(name string) (*nodefs.Inode, fuse.Status) {
+	n.mu.Lock()
+	// It may have been added in the meantime
+	ch := n.Inode().GetChild(name)
+	missed, ok := n.misses[name]
+	n.mu.Unlock()
+
+	if ch != nil {
+		return ch, fuse.OK
+	}
+	if ok && time.Since(missed) < n.fs.opts.MinNamespaceDirUpdateDelay {
+		return nil, fuse.ENOENT
+	}
+
+	// GitLab ignores case in paths, but we must only find the exact name
+	fullPath := n.childPath(name)
+
+	// Projects are always in a namespace
+	if n.path != "" {
+		prj, err := n.fs.client.GetProject(fullPath)
+		if err != nil && !isNotFound(err) {
+			n.fs.errorf("GetProject(%q) error: %v\n", fullPath, err)
+			return nil, errorStatus(err)
+		}
+		if err == nil && prj.PathWithNamespace == fullPath {
+			shown, err := n.fs.projectShown(prj)
+			if err != nil {
+				n.fs.errorf("Filtering project %q error: %v\n", fullPath, err)
+				return nil, errorStatus(err)
+			}
+			if shown {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				return n.fs.addProject(prj), fuse.OK
+			}
+		}
+	}
+
+	if n.fs.opts.showNamespace(fullPath) {
+		ns, err := n.fs.client.GetNamespace(fullPath)
+		if err != nil && !isNotFound(err) {
+			n.fs.errorf("GetNamespace(%q) error: %v\n", fullPath, err)
+			return nil, errorStatus(err)
+		}
+		if err == nil && ns.FullPath == fullPath {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return n.fs.getNamespaceInode(ns.FullPath, ns.Kind), fuse.OK
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.misses == nil {
+		n.misses = make(map[string]time.Time)
+	}
+	n.misses[name] = time.Now()
+	return nil, fuse.ENOENT
+}
+
+func (n *namespaceNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *namespaceNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("namespaceNode.OpenDir(%q)\n", n.path)
+
+	if err := n.fetch(); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *namespaceNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("namespaceNode.Lookup(%q, %q)\n", n.path, name)
+
+	ch, status := n.lookup(name)
+	if !status.Ok() {
+		return nil, status
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/*****/
+
+// listRootNamespaces returns the top-level groups, and the namespace of the
+// user, if any.
+func (fs *GitlabFs) listRootNamespaces() ([]*gitlab.Namespace, error) {
+	groups, err := fs.client.GetAllTopLevelGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*gitlab.Namespace
+	for _, group := range groups {
+		result = append(result, &gitlab.Namespace{
+			ID:       group.ID,
+			Name:     group.Name,
+			Path:     group.Path,
+			Kind:     "group",
+			FullPath: group.FullPath,
+		})
+	}
+
+	user, err := fs.client.GetCurrentUser()
+	switch {
+	case err == nil:
+		result = append(result, &gitlab.Namespace{
+			ID:       user.ID,
+			Name:     user.Name,
+			Path:     user.Username,
+			Kind:     "user",
+			FullPath: user.Username,
+		})
+	case apiStatusCode(err) != http.StatusUnauthorized:
+		// Without a token, there is no user
+		return nil, err
+	}
+	return result, nil
+}
+
+// listProjects returns a map of namespace full path to the projects in that
+// namespace which pass the filters in fs.opts, except the patterns. Only the
+// projects in the namespace with the given full path and kind, or in its
+// subgroups, are listed; an empty path lists those in all of the Groups,
+// which must be set.
+func (fs *GitlabFs) listProjects(path, kind string) (map[string][]*gitlab.Project, error) {
+	groups := fs.opts.Groups
+	if len(groups) == 0 {
+		if kind == "user" {
+			return fs.client.GetAllUserProjects(path, fs.opts.projectListOptions())
+		}
+		groups = []string{path}
+	} else if path != "" {
+		// Only the groups (or subgroups) which are in the namespace
+		var within []string
+		for _, group := range groups {
+			if group == path || strings.HasPrefix(path, group+"/") {
+				within = []string{path}
+				break
+			}
+			if strings.HasPrefix(group, path+"/") {
+				within = append(within, group)
+			}
+		}
+		groups = within
+	}
+
+	// A project is listed once for each of the groups (or their parents)
+	// it is in
+	result := make(map[string][]*gitlab.Project)
+	seen := make(map[int]bool)
+	for _, group := range groups {
+		prjmap, err := fs.client.GetAllGroupProjects(group, fs.opts.groupProjectListOptions())
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", group, err)
+		}
+		for ns, projects := range prjmap {
+			for _, prj := range projects {
+				if !seen[prj.ID] {
+					seen[prj.ID] = true
+					result[ns] = append(result[ns], prj)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// projectShown returns true if a project passes all of the filters in
+// fs.opts.
+func (fs *GitlabFs) projectShown(prj *gitlab.Project) (bool, error) {
+	if !fs.opts.showProject(prj.PathWithNamespace) {
+		return false, nil
+	}
+	if len(fs.opts.Groups) != 0 && !fs.opts.inGroups(prj.Namespace.FullPath) {
+		return false, nil
+	}
+	if !fs.opts.filtersProjects() {
+		return true, nil
+	}
+
+	// Leave the remaining filters to GitLab
+	return fs.client.IsProjectListed(prj.ID, fs.opts.projectListOptions())
+}
@@ -0,0 +1,329 @@
+package gitlabfs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Pipeline paths are composed like this:
+ * <project>/
+ *     pipelines/
+ *         <pipeline_id>/
+ *             status
+ *             ref
+ *             sha
+ *             source
+ *             stages/
+ *                 <stage>/
+ *                     <job_name> -> ../../../../jobs/<job_id>
+ *         latest/
+ *             <ref> -> ../<pipeline_id>
+ *
+ * Slashes in ref names are replaced by underscores under latest/, like in
+ * stage and job names. Branches and tags share latest/, so unlike in
+ * repo/branches/, one ref can be a prefix directory of another (a branch
+ * "foo" and a tag "foo/bar").
+ */
+
+// pathName makes an arbitrary name (e.g. a job name) usable as a single path
+// component.
+func pathName(name string) string {
+	return strings.Replace(name, "/", "_", -1)
+}
+
+/******************************************************************************/
+/* <project>/pipelines/ */
+
+type projectPipelinesNode struct {
+	nodefs.Node
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *projectPipelinesNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *projectPipelinesNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("projectPipelinesNode.fetch() sinceLastUpdate=%v\n", sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinPipelinesDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	// Get all of the pipelines from the API
+	pipelines, err := n.fs.client.GetAllProjectPipelines(n.prjID)
+	if err != nil {
+		n.fs.errorf("GetAllProjectPipelines(%d) error: %v\n", n.prjID, err)
+		return err
+	}
+
+	// Get a map of all existing pipeline inodes
+	existing := n.Inode().Children()
+
+	// Add new ones, and find the latest pipeline for each ref (by the
+	// name it has under latest/)
+	listed := make(map[string]bool)
+	latest := make(map[string]int)
+	for _, p := range pipelines {
+		if name := pathName(p.Ref); p.ID > latest[name] {
+			latest[name] = p.ID
+		}
+
+		listed[strconv.Itoa(p.ID)] = true
+		ch, exists := existing[strconv.Itoa(p.ID)]
+		if !exists {
+			n.addNewPipelineDirNode(p)
+		} else if dir, ok := ch.Node().(*dirNode); ok {
+			dir.mtime.update(p.UpdatedAt)
+			if st := ch.GetChild("status"); st != nil {
+				st.Node().(*pipelineStatusNode).setStatus(p.Status)
+			}
+		}
+	}
+
+	// Remove pipelines which no longer exist
+	for name := range existing {
+		if _, err := strconv.Atoi(name); err == nil && !listed[name] {
+			n.fs.debug.Printf("Removing pipeline inode (%s) from project (%d)\n", name, n.prjID)
+			n.fs.removeChild(n.Inode(), name)
+		}
+	}
+
+	// Make "latest/<ref>" symlinks, and remove those of refs which no
+	// longer have any pipelines
+	latestInode := n.Inode().GetChild("latest")
+	if latestInode == nil {
+		latestInode = n.Inode().NewChild("latest", true, NewDirNode(n.activity))
+	}
+	for name, pipelineID := range latest {
+		n.fs.setSymlink(latestInode, name, "../"+strconv.Itoa(pipelineID))
+	}
+	for name := range latestInode.Children() {
+		if _, ok := latest[name]; !ok {
+			n.fs.removeChild(latestInode, name)
+		}
+	}
+
+	return nil
+}
+
+func (n *projectPipelinesNode) addNewPipelineDirNode(p *gitlab.PipelineInfo) {
+	n.fs.debug.Printf("Adding new pipeline inode (%d) to project (%d)\n", p.ID, n.prjID)
+
+	// Everything in the pipeline directory has the time the pipeline was
+	// last updated
+	mtime := newSharedTime(p.UpdatedAt)
+
+	// Add the pipelines/1234 directory
+	dirInode := n.Inode().NewChild(strconv.Itoa(p.ID), true, NewDirNode(mtime))
+
+	// Add the pipelines/1234/xxx files
+	dirInode.NewChild("status", false, &pipelineStatusNode{
+		Node:       nodefs.NewDefaultNode(),
+		fs:         n.fs,
+		prjID:      n.prjID,
+		pipelineID: p.ID,
+		mtime:      mtime,
+		status:     p.Status,
+	})
+	dirInode.NewChild("ref", false, NewStaticFileNode(p.Ref+"\n", timeOf(p.CreatedAt)))
+	dirInode.NewChild("sha", false, NewStaticFileNode(p.SHA+"\n", timeOf(p.CreatedAt)))
+	dirInode.NewChild("source", false, NewStaticFileNode(p.Source+"\n", timeOf(p.CreatedAt)))
+	dirInode.NewChild("stages", true, &pipelineStagesNode{
+		Node:       nodefs.NewDefaultNode(),
+		fs:         n.fs,
+		prjID:      n.prjID,
+		pipelineID: p.ID,
+		mtime:      mtime,
+	})
+}
+
+func (n *projectPipelinesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *projectPipelinesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("projectPipelinesNode.OpenDir(%d)\n", n.prjID)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *projectPipelinesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("projectPipelinesNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* pipelines/<id>/status */
+
+type pipelineStatusNode struct {
+	nodefs.Node
+	fs         *GitlabFs
+	prjID      int
+	pipelineID int
+	mtime      *sharedTime
+
+	// The most recently fetched status
+	mu     sync.Mutex
+	status string
+}
+
+func (n *pipelineStatusNode) data() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return []byte(n.status + "\n")
+}
+
+func (n *pipelineStatusNode) setStatus(status string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.status = status
+}
+
+func (n *pipelineStatusNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, n.mtime.get())
+	if file != nil {
+		return file.GetAttr(out)
+	}
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.data()))
+	return fuse.OK
+}
+
+func (n *pipelineStatusNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	p, err := n.fs.client.GetPipeline(n.prjID, n.pipelineID)
+	if err != nil {
+		n.fs.errorf("GetPipeline(%d, %d) error: %v\n", n.prjID, n.pipelineID, err)
+		return nil, errorStatus(err)
+	}
+	n.mtime.update(p.UpdatedAt)
+	n.setStatus(p.Status)
+	return newVolatileDataFile(n.data()), fuse.OK
+}
+
+/******************************************************************************/
+/* pipelines/<id>/stages/ */
+
+type pipelineStagesNode struct {
+	nodefs.Node
+	fs         *GitlabFs
+	prjID      int
+	pipelineID int
+	mtime      *sharedTime
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+func (n *pipelineStagesNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *pipelineStagesNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("pipelineStagesNode.fetch(%d) sinceLastUpdate=%v\n", n.pipelineID, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinPipelinesDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	// Retried jobs are not included, so each job name maps to its most
+	// recent job.
+	jobs, err := n.fs.client.GetAllPipelineJobs(n.prjID, n.pipelineID)
+	if err != nil {
+		n.fs.errorf("GetAllPipelineJobs(%d, %d) error: %v\n", n.prjID, n.pipelineID, err)
+		return err
+	}
+
+	for _, job := range jobs {
+		stage := pathName(job.Stage)
+		stageInode := n.Inode().GetChild(stage)
+		if stageInode == nil {
+			stageInode = n.Inode().NewChild(stage, true, NewDirNode(n.mtime))
+		}
+
+		n.fs.setSymlink(stageInode, pathName(job.Name), "../../../../jobs/"+strconv.Itoa(job.ID))
+	}
+
+	return nil
+}
+
+func (n *pipelineStagesNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.mtime.get())
+}
+
+func (n *pipelineStagesNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("pipelineStagesNode.OpenDir(%d, %d)\n", n.prjID, n.pipelineID)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *pipelineStagesNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("pipelineStagesNode.Lookup(%q)\n", name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
@@ -0,0 +1,469 @@
+package gitlabfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+/**
+ * Repository paths are composed like this:
+ * <project>/
+ *     repo/
+ *         branches/
+ *             <branch_name>/
+ *                 <tree>
+ *         tags/
+ *             <tag_name>/
+ *                 <tree>
+ *         commits/
+ *             <sha>/
+ *                 <tree>
+ *
+ * Branch and tag names containing slashes are represented as nested
+ * directories. Git does not allow a ref to be a prefix directory of another
+ * ref, so this never collides.
+ *
+ * The commits/ directory can't be listed; a commit's tree appears when it is
+ * looked up by (possibly abbreviated) SHA.
+ */
+
+/******************************************************************************/
+/* <project>/repo/ */
+
+func (fs *GitlabFs) addProjectRepoDir(prjInode *nodefs.Inode, prjID int, activity *sharedTime) {
+	repoInode := prjInode.NewChild("repo", true, NewDirNode(activity))
+
+	repoInode.NewChild("branches", true, &repoRefsNode{
+		Node:     nodefs.NewDefaultNode(),
+		fs:       fs,
+		prjID:    prjID,
+		activity: activity,
+		kind:     "branches",
+	})
+	repoInode.NewChild("tags", true, &repoRefsNode{
+		Node:     nodefs.NewDefaultNode(),
+		fs:       fs,
+		prjID:    prjID,
+		activity: activity,
+		kind:     "tags",
+	})
+	repoInode.NewChild("commits", true, &repoCommitsNode{
+		Node:     nodefs.NewDefaultNode(),
+		fs:       fs,
+		prjID:    prjID,
+		activity: activity,
+	})
+}
+
+/******************************************************************************/
+/* repo/branches/ and repo/tags/ */
+
+type repoRefsNode struct {
+	nodefs.Node
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+	kind     string // "branches" or "tags"
+
+	lister
+
+	// Held while updating
+	mu         sync.Mutex
+	lastUpdate time.Time
+}
+
+// getRefs returns a map of ref name to the commit it points at.
+func (n *repoRefsNode) getRefs() (map[string]*gitlab.Commit, error) {
+	result := make(map[string]*gitlab.Commit)
+
+	switch n.kind {
+	case "branches":
+		branches, err := n.fs.client.GetAllBranches(n.prjID)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range branches {
+			result[b.Name] = b.Commit
+		}
+	case "tags":
+		tags, err := n.fs.client.GetAllTags(n.prjID)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			result[t.Name] = t.Commit
+		}
+	}
+
+	return result, nil
+}
+
+func (n *repoRefsNode) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastUpdate = time.Time{}
+}
+
+func (n *repoRefsNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sinceLastUpdate := time.Since(n.lastUpdate)
+	n.fs.debug.Printf("repoRefsNode.fetch(%s) sinceLastUpdate=%v\n", n.kind, sinceLastUpdate)
+
+	// Is it time to update yet?
+	if sinceLastUpdate < n.fs.opts.MinRefsDirUpdateDelay {
+		// Not time yet
+		return nil
+	}
+	n.lastUpdate = time.Now()
+
+	refs, err := n.getRefs()
+	if err != nil {
+		n.fs.errorf("Get %s (prjID=%d) error: %v\n", n.kind, n.prjID, err)
+		return err
+	}
+
+	// Remove refs which no longer exist, or which were moved to another
+	// commit. The latter are re-added below.
+	for name, tree := range n.refTrees(n.Inode(), "") {
+		commit, ok := refs[name]
+		if !ok || commit == nil || commit.ID != tree.ref {
+			n.removeRef(name)
+		}
+	}
+
+	// Add new ones
+	for name, commit := range refs {
+		if commit == nil {
+			continue
+		}
+		n.addRef(name, commit)
+	}
+
+	return nil
+}
+
+// refTrees returns a map of ref name to the tree node representing it, for
+// every ref below inode.
+func (n *repoRefsNode) refTrees(inode *nodefs.Inode, prefix string) map[string]*repoTreeNode {
+	result := make(map[string]*repoTreeNode)
+
+	for name, ch := range inode.Children() {
+		if tree, ok := ch.Node().(*repoTreeNode); ok {
+			result[prefix+name] = tree
+			continue
+		}
+		for k, v := range n.refTrees(ch, prefix+name+"/") {
+			result[k] = v
+		}
+	}
+
+	return result
+}
+
+func (n *repoRefsNode) addRef(name string, commit *gitlab.Commit) {
+	comps := strings.Split(name, "/")
+
+	node := n.Inode()
+	for i, c := range comps {
+		child := node.GetChild(c)
+		if child == nil {
+			if i == len(comps)-1 {
+				n.fs.debug.Printf("Adding %s/%s (%s) to project (%d)\n", n.kind, name, commit.ID, n.prjID)
+				child = node.NewChild(c, true, NewRepoTreeNode(n.fs, n.prjID, commit.ID, "", timeOf(commit.CommittedDate)))
+			} else {
+				child = node.NewChild(c, true, NewDirNode(n.activity))
+			}
+		}
+		node = child
+	}
+}
+
+func (n *repoRefsNode) removeRef(name string) {
+	n.fs.debug.Printf("Removing %s/%s from project (%d)\n", n.kind, name, n.prjID)
+	comps := strings.Split(name, "/")
+
+	// Walk down to the parent of the ref
+	parents := []*nodefs.Inode{n.Inode()}
+	for _, c := range comps[:len(comps)-1] {
+		ch := parents[len(parents)-1].GetChild(c)
+		if ch == nil {
+			return
+		}
+		parents = append(parents, ch)
+	}
+
+	// Remove it, and any intermediate directories left empty
+	for i := len(comps) - 1; i >= 0; i-- {
+		parent := parents[i]
+		n.fs.removeChild(parent, comps[i])
+		if i == 0 || len(parent.Children()) != 0 {
+			break
+		}
+	}
+}
+
+func (n *repoRefsNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *repoRefsNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("repoRefsNode.OpenDir(%d, %s)\n", n.prjID, n.kind)
+
+	if err := n.list(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *repoRefsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("repoRefsNode.Lookup(%s, %q)\n", n.kind, name)
+
+	if err := n.listForLookup(n.fetch); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* repo/commits/ */
+
+// isCommitSHA returns true if name looks like a (possibly abbreviated) commit
+// SHA. Other names which GitLab would resolve (e.g. branch names) are rejected
+// here, since the trees under commits/ are never refreshed.
+func isCommitSHA(name string) bool {
+	if len(name) < 4 || len(name) > 40 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+type repoCommitsNode struct {
+	nodefs.Node
+	fs       *GitlabFs
+	prjID    int
+	activity *sharedTime
+
+	// Held while adding a commit
+	mu sync.Mutex
+}
+
+func (n *repoCommitsNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	return dirAttr(out, n.activity.get())
+}
+
+func (n *repoCommitsNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("repoCommitsNode.Lookup(%q)\n", name)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		if !isCommitSHA(name) {
+			return nil, fuse.ENOENT
+		}
+		commit, _, err := n.fs.client.Commits.GetCommit(n.prjID, name)
+		if isNotFound(err) {
+			return nil, fuse.ENOENT
+		}
+		if err != nil {
+			n.fs.errorf("GetCommit(%d, %q) error: %v\n", n.prjID, name, err)
+			return nil, errorStatus(err)
+		}
+		ch = n.Inode().NewChild(name, true, NewRepoTreeNode(n.fs, n.prjID, commit.ID, "", timeOf(commit.CommittedDate)))
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/******************************************************************************/
+/* Repository tree */
+
+type repoTreeNode struct {
+	nodefs.Node
+	fs    *GitlabFs
+	prjID int
+	ref   string    // commit SHA
+	path  string    // path within the repository, "" for the root
+	mtime time.Time // date of the commit
+
+	// Held while fetching the tree
+	mu      sync.Mutex
+	fetched bool
+}
+
+func NewRepoTreeNode(fs *GitlabFs, prjID int, ref, path string, mtime time.Time) *repoTreeNode {
+	return &repoTreeNode{
+		Node:  nodefs.NewDefaultNode(),
+		fs:    fs,
+		prjID: prjID,
+		ref:   ref,
+		path:  path,
+		mtime: mtime,
+	}
+}
+
+func (n *repoTreeNode) fetch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.fetched {
+		return nil
+	}
+
+	entries, err := n.fs.client.GetRepositoryTree(n.prjID, n.path, n.ref)
+	if err != nil {
+		n.fs.errorf("GetRepositoryTree(%d, %q, %q) error: %v\n", n.prjID, n.path, n.ref, err)
+		return err
+	}
+
+	for _, e := range entries {
+		switch e.Type {
+		case "tree":
+			n.Inode().NewChild(e.Name, true, NewRepoTreeNode(n.fs, n.prjID, n.ref, e.Path, n.mtime))
+		case "blob":
+			n.Inode().NewChild(e.Name, false, &repoBlobNode{
+				Node:  nodefs.NewDefaultNode(),
+				fs:    n.fs,
+				prjID: n.prjID,
+				ref:   n.ref,
+				path:  e.Path,
+				mode:  e.Mode,
+				mtime: n.mtime,
+			})
+		default:
+			// Submodules ("commit") are not represented
+			n.fs.debug.Printf("Skipping %s %q\n", e.Type, e.Path)
+		}
+	}
+
+	n.fetched = true
+	return nil
+}
+
+func (n *repoTreeNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFDIR | 0555
+	setTimes(out, n.mtime)
+	return fuse.OK
+}
+
+func (n *repoTreeNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.fs.debug.Printf("repoTreeNode.OpenDir(%d, %q, %q)\n", n.prjID, n.ref, n.path)
+
+	if err := n.fetch(); err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return n.Node.OpenDir(context)
+}
+
+func (n *repoTreeNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.debug.Printf("repoTreeNode.Lookup(%q) (prjID=%d ref=%q path=%q)\n", name, n.prjID, n.ref, n.path)
+
+	if err := n.fetch(); err != nil {
+		return nil, errorStatus(err)
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+/*****/
+
+type repoBlobNode struct {
+	nodefs.Node
+	fs    *GitlabFs
+	prjID int
+	ref   string
+	path  string
+	mode  string // git file mode, e.g. "100644"
+	mtime time.Time
+
+	// The size, once the blob was read. It never changes, since ref is a
+	// commit SHA. Until then GetAttr reports 0, rather than asking GitLab on
+	// every stat; the contents are served bypassing the page cache.
+	mu   sync.Mutex
+	size uint64
+}
+
+func (n *repoBlobNode) getContents() ([]byte, error) {
+	opt := &gitlab.GetRawFileOptions{
+		Ref: gitlab.String(n.ref),
+	}
+	buf, _, err := n.fs.client.RepositoryFiles.GetRawFile(n.prjID, n.path, opt)
+	if err == nil {
+		n.mu.Lock()
+		n.size = uint64(len(buf))
+		n.mu.Unlock()
+	}
+	return buf, err
+}
+
+func (n *repoBlobNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	defer setTimes(out, n.mtime)
+	if file != nil {
+		return file.GetAttr(out)
+	}
+	switch n.mode {
+	case "120000":
+		out.Mode = fuse.S_IFLNK | 0777
+	case "100755":
+		out.Mode = fuse.S_IFREG | 0555
+	default:
+		out.Mode = fuse.S_IFREG | 0444
+	}
+
+	n.mu.Lock()
+	out.Size = n.size
+	n.mu.Unlock()
+	return fuse.OK
+}
+
+func (n *repoBlobNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	if n.mode != "120000" {
+		return nil, fuse.EINVAL
+	}
+
+	link, err := n.getContents()
+	if err != nil {
+		n.fs.errorf("GetRawFile(%d, %q, %q) error: %v\n", n.prjID, n.path, n.ref, err)
+		return nil, errorStatus(err)
+	}
+	return link, fuse.OK
+}
+
+func (n *repoBlobNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+
+	buf, err := n.getContents()
+	if err != nil {
+		n.fs.errorf("GetRawFile(%d, %q, %q) error: %v\n", n.prjID, n.path, n.ref, err)
+		return nil, errorStatus(err)
+	}
+
+	return newVolatileDataFile(buf), fuse.OK
+}
@@ -0,0 +1,183 @@
+package gitlabfs
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/time/rate"
+)
+
+/**
+ * Requests which fail for reasons that are likely to pass are retried, with
+ * exponential backoff:
+ * - 429 Too Many Requests, after the time given by the Retry-After or
+ *   RateLimit-Reset header, if there is one
+ * - 5xx server errors, e.g. a 502 while GitLab is restarting
+ * - Network errors, e.g. a reset connection
+ *
+ * Requests which change something (e.g. retrying a job) are only retried
+ * after a 429, since they may have been carried out despite the other errors.
+ */
+
+const (
+	retryMinDelay = 500 * time.Millisecond
+	retryMaxDelay = 30 * time.Second
+
+	// If the server asks to wait longer than this, its response is returned
+	// instead
+	retryMaxServerDelay = 2 * time.Minute
+)
+
+// RetryTransport is an http.RoundTripper retrying failed requests to GitLab.
+// The client's own retries should be disabled (gitlab.WithoutRetries) when
+// using it.
+type RetryTransport struct {
+	base        http.RoundTripper
+	maxAttempts int
+	debug       *log.Logger
+}
+
+// NewRetryTransport returns a RetryTransport making requests using base, at
+// most maxAttempts times each.
+func NewRetryTransport(base http.RoundTripper, maxAttempts int) *RetryTransport {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryTransport{
+		base:        base,
+		maxAttempts: maxAttempts,
+		debug:       log.New(ioutil.Discard, "RETRY: ", log.Lshortfile|log.LstdFlags),
+	}
+}
+
+func (t *RetryTransport) SetDebugLogOutput(w io.Writer) {
+	t.debug.SetOutput(w)
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Without a way to get the body again, it can only be sent once
+	rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if attempt >= t.maxAttempts || !rewindable {
+			return resp, err
+		}
+		delay, retry := retryDelay(req, resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+
+		if err != nil {
+			t.debug.Printf("%s %s: %v; retrying in %v\n", req.Method, req.URL, err, delay)
+		} else {
+			t.debug.Printf("%s %s: %s; retrying in %v\n", req.Method, req.URL, resp.Status, delay)
+
+			// Let the connection be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryDelay returns whether to retry a request after the given attempt
+// failed with resp or err, and how long to wait before doing so.
+func retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+
+	if err != nil {
+		if req.Context().Err() != nil || !idempotent {
+			return 0, false
+		}
+		return backoff(attempt), true
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented && idempotent:
+	default:
+		return 0, false
+	}
+
+	if delay, ok := serverDelay(resp); ok {
+		return delay, delay <= retryMaxServerDelay
+	}
+	return backoff(attempt), true
+}
+
+// backoff returns the time to wait after the given attempt failed: twice as
+// long after each attempt, with some jitter so that concurrent requests don't
+// all retry at once.
+func backoff(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 {
+		if d := retryMinDelay << uint(attempt-1); d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// serverDelay returns the time the server asked to wait before trying again,
+// if it did.
+func serverDelay(resp *http.Response) (time.Duration, bool) {
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return nonNegative(time.Until(t)), true
+		}
+	}
+
+	// The time (in seconds since the epoch) when the rate limit is reset
+	if v := resp.Header.Get("RateLimit-Reset"); v != "" {
+		if reset, err := strconv.ParseInt(v, 10, 64); err == nil && reset > 0 {
+			return nonNegative(time.Until(time.Unix(reset, 0))), true
+		}
+	}
+
+	return 0, false
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// NewRateLimiter returns a limiter for gitlab.WithCustomLimiter, allowing
+// requestsPerSecond requests on average, and short bursts of up to a second's
+// worth.
+func NewRateLimiter(requestsPerSecond float64) gitlab.RateLimiter {
+	burst := int(requestsPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+}
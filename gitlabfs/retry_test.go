@@ -0,0 +1,187 @@
+package gitlabfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	netErr := errors.New("connection reset by peer")
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+		header http.Header
+		err    error
+		retry  bool
+	}{
+		{"GET 200", http.MethodGet, 200, nil, nil, false},
+		{"GET 404", http.MethodGet, 404, nil, nil, false},
+		{"GET 429", http.MethodGet, 429, nil, nil, true},
+		{"GET 500", http.MethodGet, 500, nil, nil, true},
+		{"GET 501", http.MethodGet, 501, nil, nil, false},
+		{"GET 502", http.MethodGet, 502, nil, nil, true},
+		{"HEAD 503", http.MethodHead, 503, nil, nil, true},
+		{"GET network error", http.MethodGet, 0, nil, netErr, true},
+		{"POST 429", http.MethodPost, 429, nil, nil, true},
+		{"POST 502", http.MethodPost, 502, nil, nil, false},
+		{"POST network error", http.MethodPost, 0, nil, netErr, false},
+		{"DELETE 500", http.MethodDelete, 500, nil, nil, false},
+		{"GET 429 short Retry-After", http.MethodGet, 429,
+			http.Header{"Retry-After": {"10"}}, nil, true},
+		{"GET 429 long Retry-After", http.MethodGet, 429,
+			http.Header{"Retry-After": {"3600"}}, nil, false},
+		{"POST 429 long RateLimit-Reset", http.MethodPost, 429,
+			http.Header{"Ratelimit-Reset": {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://gitlab.example/api/v4/projects", nil)
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status, Header: tt.header}
+				if resp.Header == nil {
+					resp.Header = http.Header{}
+				}
+			}
+
+			_, retry := retryDelay(req, resp, tt.err, 1)
+			if retry != tt.retry {
+				t.Errorf("retry = %v, want %v", retry, tt.retry)
+			}
+		})
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		ok     bool
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"none", http.Header{}, false, 0, 0},
+		{"Retry-After seconds", http.Header{"Retry-After": {"30"}}, true, 30 * time.Second, 30 * time.Second},
+		{"Retry-After zero", http.Header{"Retry-After": {"0"}}, true, 0, 0},
+		{"Retry-After date", http.Header{"Retry-After": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}},
+			true, 58 * time.Second, time.Minute},
+		{"Retry-After past date", http.Header{"Retry-After": {now.Add(-time.Minute).UTC().Format(http.TimeFormat)}},
+			true, 0, 0},
+		{"Retry-After invalid", http.Header{"Retry-After": {"soon"}}, false, 0, 0},
+		{"RateLimit-Reset", http.Header{"Ratelimit-Reset": {strconv.FormatInt(now.Add(time.Minute).Unix(), 10)}},
+			true, 58 * time.Second, time.Minute},
+		{"RateLimit-Reset past", http.Header{"Ratelimit-Reset": {strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)}},
+			true, 0, 0},
+		{"Retry-After before RateLimit-Reset", http.Header{
+			"Retry-After":     {"5"},
+			"Ratelimit-Reset": {strconv.FormatInt(now.Add(time.Minute).Unix(), 10)},
+		}, true, 5 * time.Second, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := serverDelay(&http.Response{Header: tt.header})
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if delay < tt.min || delay > tt.max {
+				t.Errorf("delay = %v, want between %v and %v", delay, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 20; attempt++ {
+		want := retryMaxDelay
+		if attempt < 16 {
+			if d := retryMinDelay << uint(attempt-1); d < want {
+				want = d
+			}
+		}
+
+		delay := backoff(attempt)
+		if delay < want/2 || delay > want {
+			t.Errorf("backoff(%d) = %v, want between %v and %v", attempt, delay, want/2, want)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		statuses []int // The responses to the attempts, the last one repeated
+		header   string
+		attempts int
+		status   int
+	}{
+		{"GET succeeds", http.MethodGet, []int{200}, "0", 1, 200},
+		{"GET retried after 502", http.MethodGet, []int{502, 200}, "0", 2, 200},
+		{"GET gives up", http.MethodGet, []int{503}, "0", 3, 503},
+		{"GET not retried after 404", http.MethodGet, []int{404}, "0", 1, 404},
+		{"POST not retried after 502", http.MethodPost, []int{502, 200}, "0", 1, 502},
+		{"POST retried after 429", http.MethodPost, []int{429, 201}, "0", 2, 201},
+		{"GET not retried after long Retry-After", http.MethodGet, []int{429, 200}, "3600", 1, 429},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+
+				mu.Lock()
+				defer mu.Unlock()
+				bodies = append(bodies, string(body))
+
+				status := tt.statuses[len(tt.statuses)-1]
+				if len(bodies) <= len(tt.statuses) {
+					status = tt.statuses[len(bodies)-1]
+				}
+				w.Header().Set("Retry-After", tt.header)
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{Transport: NewRetryTransport(http.DefaultTransport, 3)}
+			req, err := http.NewRequest(tt.method, srv.URL, strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(bodies) != tt.attempts {
+				t.Errorf("%d attempts, want %d", len(bodies), tt.attempts)
+			}
+			// Retried requests are sent with the whole body again
+			for i, body := range bodies {
+				if body != "data" {
+					t.Errorf("attempt %d: body = %q, want %q", i+1, body, "data")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package gitlabfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Stats counts the requests a client makes to GitLab, for .gitlabfs/stats.
+ * Requests are grouped by endpoint, i.e. method and API path with the IDs
+ * and paths of projects, jobs etc. left out:
+ *     GET /projects/:id/jobs/:id/trace
+ */
+
+type Stats struct {
+	mu        sync.Mutex
+	requests  int64
+	failures  int64
+	bytes     int64
+	endpoints map[string]*endpointStats
+}
+
+type endpointStats struct {
+	requests int64
+	total    time.Duration
+	max      time.Duration
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		endpoints: make(map[string]*endpointStats),
+	}
+}
+
+// Transport returns an http.RoundTripper making requests using base, and
+// counting them.
+func (s *Stats) Transport(base http.RoundTripper) http.RoundTripper {
+	return &statsTransport{
+		base:  base,
+		stats: s,
+	}
+}
+
+// record counts a request to endpoint, which took d until the response
+// arrived (or failed).
+func (s *Stats) record(endpoint string, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if failed {
+		s.failures++
+	}
+
+	e := s.endpoints[endpoint]
+	if e == nil {
+		e = &endpointStats{}
+		s.endpoints[endpoint] = e
+	}
+	e.requests++
+	e.total += d
+	if d > e.max {
+		e.max = d
+	}
+}
+
+func (s *Stats) addBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += int64(n)
+}
+
+// String returns the stats in a readable form.
+func (s *Stats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "requests: %d\n", s.requests)
+	fmt.Fprintf(&b, "failed_requests: %d\n", s.failures)
+	fmt.Fprintf(&b, "bytes_downloaded: %d\n", s.bytes)
+
+	names := make([]string, 0, len(s.endpoints))
+	for name := range s.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) != 0 {
+		fmt.Fprintf(&b, "\n%-60s %8s %10s %10s\n", "endpoint", "requests", "avg", "max")
+	}
+	for _, name := range names {
+		e := s.endpoints[name]
+		avg := e.total / time.Duration(e.requests)
+		fmt.Fprintf(&b, "%-60s %8d %10v %10v\n", name, e.requests,
+			avg.Round(time.Millisecond), e.max.Round(time.Millisecond))
+	}
+
+	return b.String()
+}
+
+/*****/
+
+type statsTransport struct {
+	base  http.RoundTripper
+	stats *Stats
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t0 := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	failed := err != nil || resp.StatusCode >= 400
+	t.stats.record(endpointName(req), time.Since(t0), failed)
+
+	if resp != nil {
+		resp.Body = &statsBody{
+			ReadCloser: resp.Body,
+			stats:      t.stats,
+		}
+	}
+	return resp, err
+}
+
+// statsBody counts the bytes read from a response.
+type statsBody struct {
+	io.ReadCloser
+	stats *Stats
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.stats.addBytes(n)
+	return n, err
+}
+
+// The API path segments followed by an ID or a (URL-encoded) path
+var idAfter = map[string]bool{
+	"projects":       true,
+	"groups":         true,
+	"namespaces":     true,
+	"users":          true,
+	"jobs":           true,
+	"pipelines":      true,
+	"merge_requests": true,
+	"issues":         true,
+	"notes":          true,
+	"discussions":    true,
+	"branches":       true,
+	"tags":           true,
+	"files":          true,
+}
+
+var numberRe = regexp.MustCompile(`^[0-9]+$`)
+
+// endpointName returns the method and API path of a request, with IDs and
+// paths replaced by ":id".
+func endpointName(req *http.Request) string {
+	p := req.URL.EscapedPath()
+	if i := strings.Index(p, "/api/v4/"); i >= 0 {
+		p = p[i+len("/api/v4"):]
+	}
+
+	segs := strings.Split(p, "/")
+	for i := 1; i < len(segs); i++ {
+		if segs[i-1] == "artifacts" && i >= 3 && segs[i-3] == "jobs" {
+			// A file in the artifacts archive
+			segs = append(segs[:i], ":path")
+			break
+		}
+		if idAfter[segs[i-1]] || numberRe.MatchString(segs[i]) {
+			segs[i] = ":id"
+		}
+	}
+
+	return req.Method + " " + strings.Join(segs, "/")
+}
@@ -0,0 +1,45 @@
+package gitlabfs
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEndpointName(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{"GET", "https://gitlab.example/api/v4/user", "GET /user"},
+		{"GET", "https://gitlab.example/api/v4/projects", "GET /projects"},
+		{"GET", "https://gitlab.example/api/v4/projects/42", "GET /projects/:id"},
+		{"GET", "https://gitlab.example/api/v4/projects/group%2Fproject", "GET /projects/:id"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/jobs?page=2", "GET /projects/:id/jobs"},
+		{"POST", "https://gitlab.example/api/v4/projects/42/jobs/7/retry", "POST /projects/:id/jobs/:id/retry"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/jobs/7/trace", "GET /projects/:id/jobs/:id/trace"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/jobs/7/artifacts", "GET /projects/:id/jobs/:id/artifacts"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/jobs/7/artifacts/dir/file.txt",
+			"GET /projects/:id/jobs/:id/artifacts/:path"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/merge_requests/3/discussions",
+			"GET /projects/:id/merge_requests/:id/discussions"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/issues/3/notes", "GET /projects/:id/issues/:id/notes"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/repository/branches/feature%2Fx",
+			"GET /projects/:id/repository/branches/:id"},
+		{"HEAD", "https://gitlab.example/api/v4/projects/42/repository/files/src%2Fmain.go",
+			"HEAD /projects/:id/repository/files/:id"},
+		{"GET", "https://gitlab.example/api/v4/projects/42/repository/files/src%2Fmain.go/raw",
+			"GET /projects/:id/repository/files/:id/raw"},
+		{"GET", "https://gitlab.example/api/v4/groups/group%2Fsub/projects", "GET /groups/:id/projects"},
+		{"GET", "https://gitlab.example/gitlab/api/v4/namespaces/group", "GET /namespaces/:id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			if got := endpointName(req); got != tt.want {
+				t.Errorf("endpointName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
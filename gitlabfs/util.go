@@ -1,9 +1,16 @@
 package gitlabfs
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,9 +39,112 @@ func UnlinkedTempFile(dir, prefix string) (f *os.File, err error) {
 	return f, err
 }
 
+// requestGroup merges concurrent calls with the same key: while a call is in
+// flight, others with its key wait for it and share its result.
+type requestGroup struct {
+	mu    sync.Mutex
+	calls map[string]*requestCall
+}
+
+type requestCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *requestGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*requestCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &requestCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
+
+// ErrUnsupportedArchive is returned for archive formats we can't read.
+var ErrUnsupportedArchive = errors.New("Unsupported archive format")
+
+// ArchiveEntry is a single file or directory in an archive.
+type ArchiveEntry struct {
+	// Slash-separated path; directories end with a slash
+	Name    string
+	Size    uint64
+	ModTime time.Time
+
+	open func() (io.ReadCloser, error)
+}
+
+func (e *ArchiveEntry) Open() (io.ReadCloser, error) {
+	return e.open()
+}
+
+// ArchiveReader provides access to the entries of an archive.
+type ArchiveReader interface {
+	Entries() []*ArchiveEntry
+	Close()
+}
+
+// ArchiveFormat returns the format of an archive ("zip", "tar.gz" or "gz")
+// based on its filename, or "" if it is not supported.
+func ArchiveFormat(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".zip"):
+		return "zip"
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(filename, ".gz"):
+		return "gz"
+	}
+	return ""
+}
+
+// ArchiveReaderFromFile reads the archive in f, whose format is determined by
+// filename. The returned reader takes ownership of f.
+func ArchiveReaderFromFile(f *os.File, filename string) (ArchiveReader, error) {
+	switch ArchiveFormat(filename) {
+	case "zip":
+		r, err := ZipReaderFromFile(f)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case "tar.gz":
+		r, err := TarGzReaderFromFile(f)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case "gz":
+		r, err := GzipReaderFromFile(f, strings.TrimSuffix(filename, ".gz"))
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, ErrUnsupportedArchive
+}
+
+/*****/
+
 type ZipFileReader struct {
 	f *os.File
-	zip.Reader
+	*zip.Reader
 }
 
 func ZipReaderFromFile(f *os.File) (*ZipFileReader, error) {
@@ -50,10 +160,204 @@ func ZipReaderFromFile(f *os.File) (*ZipFileReader, error) {
 
 	return &ZipFileReader{
 		f:      f,
-		Reader: *zipr,
+		Reader: zipr,
 	}, nil
 }
 
+func (z *ZipFileReader) Entries() []*ArchiveEntry {
+	return ZipEntries(z.Reader)
+}
+
 func (z *ZipFileReader) Close() {
 	z.f.Close()
 }
+
+// ZipEntries returns the entries of a zip archive.
+func ZipEntries(zipr *zip.Reader) []*ArchiveEntry {
+	result := make([]*ArchiveEntry, 0, len(zipr.File))
+
+	for _, f := range zipr.File {
+		result = append(result, &ArchiveEntry{
+			Name:    f.Name,
+			Size:    f.UncompressedSize64,
+			ModTime: ConvertDosDateTime(f.ModifiedDate, f.ModifiedTime),
+			open:    f.Open,
+		})
+	}
+
+	return result
+}
+
+/*****/
+
+// decompressGzip decompresses the gzip data in f into a new unlinked
+// temporary file, and closes f.
+func decompressGzip(f *os.File) (*os.File, *gzip.Header, error) {
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	out, err := UnlinkedTempFile("", "gitlab-fuse-artifact")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+
+	return out, &gz.Header, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// TarFileReader reads a tar archive. Since tar archives can't be read
+// randomly, the archive is indexed once and entries are then read directly
+// from the file.
+type TarFileReader struct {
+	f       *os.File
+	entries []*ArchiveEntry
+}
+
+// TarGzReaderFromFile reads the gzip-compressed tar archive in f. It is
+// decompressed to a temporary file first.
+func TarGzReaderFromFile(f *os.File) (*TarFileReader, error) {
+	tarf, _, err := decompressGzip(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := TarReaderFromFile(tarf)
+	if err != nil {
+		tarf.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func TarReaderFromFile(f *os.File) (*TarFileReader, error) {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	r := &TarFileReader{f: f}
+
+	// Once Next() returns, the entry's data begins at the current offset
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+
+		entry := &ArchiveEntry{
+			Name:    name,
+			ModTime: hdr.ModTime,
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if !strings.HasSuffix(entry.Name, "/") {
+				entry.Name += "/"
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			off, size := cr.n, hdr.Size
+			entry.Size = uint64(size)
+			entry.open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(f, off, size)), nil
+			}
+		default:
+			// Links, devices, etc. are not represented
+			continue
+		}
+
+		r.entries = append(r.entries, entry)
+	}
+
+	return r, nil
+}
+
+func (t *TarFileReader) Entries() []*ArchiveEntry {
+	return t.entries
+}
+
+func (t *TarFileReader) Close() {
+	t.f.Close()
+}
+
+/*****/
+
+// GzipFileReader reads a gzip file as an archive containing a single entry.
+type GzipFileReader struct {
+	f     *os.File
+	entry *ArchiveEntry
+}
+
+// GzipReaderFromFile reads the gzip file in f. The single entry is named
+// after the name stored in the gzip header, or defaultName if there is none.
+func GzipReaderFromFile(f *os.File, defaultName string) (*GzipFileReader, error) {
+	out, hdr, err := decompressGzip(f)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	name := defaultName
+	if hdr.Name != "" {
+		name = path.Base(hdr.Name)
+	}
+	modTime := hdr.ModTime
+	if modTime.IsZero() {
+		modTime = fi.ModTime()
+	}
+
+	size := fi.Size()
+	return &GzipFileReader{
+		f: out,
+		entry: &ArchiveEntry{
+			Name:    name,
+			Size:    uint64(size),
+			ModTime: modTime,
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(out, 0, size)), nil
+			},
+		},
+	}, nil
+}
+
+func (g *GzipFileReader) Entries() []*ArchiveEntry {
+	return []*ArchiveEntry{g.entry}
+}
+
+func (g *GzipFileReader) Close() {
+	g.f.Close()
+}
@@ -0,0 +1,278 @@
+package gitlabfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var archiveTime = time.Date(2021, 3, 4, 5, 6, 8, 0, time.UTC)
+
+// errAny stands for any error in the tests.
+var errAny = errors.New("any error")
+
+// archiveFile is a file (or a directory, if the name ends with a slash, or a
+// symlink, if link is set) to put in a test archive.
+type archiveFile struct {
+	name string
+	data string
+	link string
+}
+
+func makeZip(t *testing.T, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		hdr.Modified = archiveTime
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: archiveTime,
+		}
+		switch {
+		case f.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = f.link
+		case f.name[len(f.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeGzip(t *testing.T, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Name = name
+	gw.ModTime = archiveTime
+	gw.Write(data)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tempFileWith returns an unlinked temporary file holding data.
+func tempFileWith(t *testing.T, data []byte) *os.File {
+	f, err := UnlinkedTempFile("", "gitlab-fuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, os.SEEK_SET)
+	return f
+}
+
+// readEntries returns the contents of the entries of an archive by their
+// names, with "" for directories.
+func readEntries(t *testing.T, r ArchiveReader) map[string]string {
+	result := make(map[string]string)
+	for _, e := range r.Entries() {
+		if e.Name[len(e.Name)-1] == '/' {
+			result[e.Name] = ""
+			continue
+		}
+		rc, err := e.Open()
+		if err != nil {
+			t.Fatalf("%s: Open() error: %v", e.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: read error: %v", e.Name, err)
+		}
+		if e.Size != uint64(len(data)) {
+			t.Errorf("%s: Size = %d, read %d bytes", e.Name, e.Size, len(data))
+		}
+		if !e.ModTime.Equal(archiveTime) {
+			t.Errorf("%s: ModTime = %v, want %v", e.Name, e.ModTime, archiveTime)
+		}
+		result[e.Name] = string(data)
+	}
+	return result
+}
+
+func TestArchiveReaderFromFile(t *testing.T) {
+	files := []archiveFile{
+		{name: "dir/"},
+		{name: "dir/a.txt", data: "hello\n"},
+		{name: "b.bin", data: string(bytes.Repeat([]byte{0, 1, 2}, 1000))},
+		{name: "empty"},
+	}
+	want := map[string]string{
+		"dir/":      "",
+		"dir/a.txt": "hello\n",
+		"b.bin":     files[2].data,
+		"empty":     "",
+	}
+
+	tarData := makeTar(t, files)
+	tarGzData := makeGzip(t, "", tarData)
+
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     map[string]string
+		err      error // If not nil, the error (or any error, for errAny)
+	}{
+		{"zip", "artifacts.zip", makeZip(t, files), want, nil},
+		{"tar.gz", "artifacts.tar.gz", tarGzData, want, nil},
+		{"tgz", "artifacts.tgz", tarGzData, want, nil},
+		{"tar.gz with ./ names and links", "artifacts.tar.gz", makeGzip(t, "", makeTar(t, []archiveFile{
+			{name: "./"},
+			{name: "./dir/"},
+			{name: "./dir/a.txt", data: "hello\n"},
+			{name: "./dir/link", link: "a.txt"},
+		})), map[string]string{"dir/": "", "dir/a.txt": "hello\n"}, nil},
+		{"gz named in header", "report.xml.gz", makeGzip(t, "dir/junit.xml", []byte("<xml/>")),
+			map[string]string{"junit.xml": "<xml/>"}, nil},
+		{"gz named after file", "report.xml.gz", makeGzip(t, "", []byte("<xml/>")),
+			map[string]string{"report.xml": "<xml/>"}, nil},
+		{"truncated zip", "artifacts.zip", makeZip(t, files)[:100], nil, errAny},
+		{"truncated tar.gz", "artifacts.tar.gz", tarGzData[:len(tarGzData)/2], nil, errAny},
+		{"tar.gz with truncated tar", "artifacts.tar.gz", makeGzip(t, "", tarData[:700]), nil, errAny},
+		{"truncated gz", "report.xml.gz", makeGzip(t, "", []byte("<xml/>"))[:15], nil, errAny},
+		{"gz which isn't gzip", "report.xml.gz", []byte("<?xml version=\"1.0\"?>\n<testsuites/>\n"), nil, gzip.ErrHeader},
+		{"unsupported", "artifacts.rar", []byte("Rar!"), nil, ErrUnsupportedArchive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ArchiveReaderFromFile(tempFileWith(t, tt.data), tt.filename)
+			if tt.err != nil {
+				if err == nil {
+					r.Close()
+					t.Fatalf("no error, want %v", tt.err)
+				}
+				if tt.err != errAny && !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			got := readEntries(t, r)
+			if len(got) != len(tt.want) {
+				t.Errorf("entries %v, want %v", keys(got), keys(tt.want))
+			}
+			for name, data := range tt.want {
+				if gotData, ok := got[name]; !ok {
+					t.Errorf("%s: missing", name)
+				} else if gotData != data {
+					t.Errorf("%s: contents %q, want %q", name, gotData, data)
+				}
+			}
+		})
+	}
+}
+
+func keys(m map[string]string) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+func TestUnsupportedArchiveStatus(t *testing.T) {
+	_, err := ArchiveReaderFromFile(tempFileWith(t, []byte("Rar!")), "artifacts.rar")
+	if status := errorStatus(err); status != fuse.Status(syscall.ENOTSUP) {
+		t.Errorf("errorStatus(%v) = %v, want ENOTSUP", err, status)
+	}
+}
+
+func TestDecompressGzip(t *testing.T) {
+	data := []byte("line 1\nline 2\n")
+	gzData := makeGzip(t, "out.log", data)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string // The header name, or "" if decompressing fails
+	}{
+		{"valid", gzData, "out.log"},
+		{"empty", []byte{}, ""},
+		{"truncated header", gzData[:5], ""},
+		{"truncated data", gzData[:len(gzData)-10], ""},
+		{"not gzip", data, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tempFileWith(t, tt.data)
+			out, hdr, err := decompressGzip(f)
+
+			// The input is closed either way
+			if _, statErr := f.Stat(); statErr == nil {
+				t.Error("input file not closed")
+			}
+
+			if tt.want == "" {
+				if err == nil {
+					out.Close()
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			if hdr.Name != tt.want {
+				t.Errorf("header name %q, want %q", hdr.Name, tt.want)
+			}
+			out.Seek(0, os.SEEK_SET)
+			got, err := ioutil.ReadAll(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decompressed %q, want %q", got, data)
+			}
+		})
+	}
+}
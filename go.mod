@@ -3,6 +3,9 @@ module github.com/JonathonReinhart/gitlab-fuse
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/hanwen/go-fuse v1.0.0
+	github.com/hashicorp/go-retryablehttp v0.6.8
 	github.com/xanzy/go-gitlab v0.65.0
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 )
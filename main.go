@@ -1,11 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +26,13 @@ import (
 
 /******************************************************************************/
 
+// Exit codes, besides 1 for bad usage or configuration (from log.Fatal)
+const (
+	exitAuth        = 2 // GitLab rejected the credentials
+	exitUnreachable = 3 // GitLab could not be reached
+	exitMount       = 4 // Mounting failed
+)
+
 // Wait for SIGINT in the background and unmount ourselves if we get it.
 // This prevents a dangling "Transport endpoint is not connected"
 // mountpoint if the user hits CTRL-C.
@@ -41,51 +57,455 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 	}()
 }
 
-func getGitlabFsOpts() *gitlabfs.Options {
+func handleSighup(fs mountedFs) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Print("Re-syncing all jobs")
+			fs.ResyncJobs()
+		}
+	}()
+}
+
+func handleSigusr1(fs mountedFs) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			log.Print("Refreshing all directories")
+			fs.Refresh()
+		}
+	}()
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix
+// (powers of 1024). The size must be positive.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+
+	num, mult := s, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		num = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q, expected a positive number of bytes", s)
+	}
+	return n * mult, nil
+}
+
+// optionValue returns the value of an option from its GITLABFS_<NAME>
+// environment variable, or else from the profile.
+func optionValue(p profile, name string) (string, bool) {
+	if sval := os.Getenv("GITLABFS_" + strings.ToUpper(name)); len(sval) != 0 {
+		return sval, true
+	}
+	return p.str(name)
+}
+
+// optionList returns the value of an option which takes a list, from its
+// (comma-separated) GITLABFS_<NAME> environment variable, or else from the
+// profile.
+func optionList(p profile, name string) []string {
+	if sval := os.Getenv("GITLABFS_" + strings.ToUpper(name)); len(sval) != 0 {
+		return strings.Split(sval, ",")
+	}
+	return p.list(name)
+}
+
+// optionBool is like optionValue, for options which are true or false.
+func optionBool(p profile, name string) bool {
+	sval, ok := optionValue(p, name)
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(sval)
+	if err != nil {
+		log.Fatalf("%s: expected true or false, got %q", name, sval)
+	}
+	return b
+}
+
+// parseAccessLevel parses an access level given by name (e.g. "developer") or
+// number.
+func parseAccessLevel(s string) (gitlab.AccessLevelValue, error) {
+	levels := map[string]gitlab.AccessLevelValue{
+		"guest":      gitlab.GuestPermissions,
+		"reporter":   gitlab.ReporterPermissions,
+		"developer":  gitlab.DeveloperPermissions,
+		"maintainer": gitlab.MaintainerPermissions,
+		"owner":      gitlab.OwnerPermissions,
+	}
+	if level, ok := levels[strings.ToLower(s)]; ok {
+		return level, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown access level %q", s)
+	}
+	return gitlab.AccessLevelValue(n), nil
+}
+
+func getGitlabFsOpts(p profile) *gitlabfs.Options {
 	opts := &gitlabfs.Options{
-		MinJobsDirUpdateDelay: 1 * time.Minute,
+		MinNamespaceDirUpdateDelay:     10 * time.Minute,
+		MinJobsDirUpdateDelay:          1 * time.Minute,
+		MinRefsDirUpdateDelay:          1 * time.Minute,
+		MinTraceUpdateDelay:            2 * time.Second,
+		MinPipelinesDirUpdateDelay:     1 * time.Minute,
+		MinMergeRequestsDirUpdateDelay: 1 * time.Minute,
+		MinIssuesDirUpdateDelay:        1 * time.Minute,
+		MaxAttempts:                    5,
+		Stats:                          gitlabfs.NewStats(),
+	}
+
+	delays := []struct {
+		name string
+		dest *time.Duration
+	}{
+		{"min_namespace_dir_update_delay", &opts.MinNamespaceDirUpdateDelay},
+		{"min_jobs_dir_update_delay", &opts.MinJobsDirUpdateDelay},
+		{"min_refs_dir_update_delay", &opts.MinRefsDirUpdateDelay},
+		{"min_trace_update_delay", &opts.MinTraceUpdateDelay},
+		{"min_pipelines_dir_update_delay", &opts.MinPipelinesDirUpdateDelay},
+		{"min_merge_requests_dir_update_delay", &opts.MinMergeRequestsDirUpdateDelay},
+		{"min_issues_dir_update_delay", &opts.MinIssuesDirUpdateDelay},
+	}
+	for _, d := range delays {
+		if sval, ok := optionValue(p, d.name); ok {
+			dur, err := time.ParseDuration(sval)
+			if err != nil {
+				log.Fatalf("%s: %v", d.name, err)
+			}
+			*d.dest = dur
+		}
+	}
+
+	if sval, ok := optionValue(p, "max_attempts"); ok {
+		n, err := strconv.Atoi(sval)
+		if err != nil || n < 1 {
+			log.Fatalf("max_attempts: expected a positive number, got %q", sval)
+		}
+		opts.MaxAttempts = n
 	}
 
-	if sval := os.Getenv("GITLABFS_MIN_JOBS_DIR_UPDATE_DELAY"); len(sval) != 0 {
-		dur, err := time.ParseDuration(sval)
+	// Without a limit of our own, the one GitLab advertises is kept to
+	if sval, ok := optionValue(p, "requests_per_second"); ok {
+		rps, err := strconv.ParseFloat(sval, 64)
+		if err != nil || rps <= 0 {
+			log.Fatalf("requests_per_second: expected a positive number, got %q", sval)
+		}
+		opts.RequestsPerSecond = rps
+	}
+
+	if dir, ok := optionValue(p, "artifact_cache_dir"); ok {
+		maxSize := int64(1 << 30)
+		if sval, ok := optionValue(p, "artifact_cache_size"); ok {
+			size, err := parseSize(sval)
+			if err != nil {
+				log.Fatalf("artifact_cache_size: %v", err)
+			}
+			maxSize = size
+		}
+
+		opts.ArtifactCache = openArtifactCache(expandHome(dir), maxSize)
+	}
+
+	opts.Groups = optionList(p, "groups")
+	opts.Membership = optionBool(p, "membership")
+	opts.Owned = optionBool(p, "owned")
+	opts.Starred = optionBool(p, "starred")
+
+	if sval, ok := optionValue(p, "archived"); ok {
+		switch sval {
+		case "include":
+		case "exclude":
+			opts.Archived = gitlab.Bool(false)
+		case "only":
+			opts.Archived = gitlab.Bool(true)
+		default:
+			log.Fatalf("archived: expected include, exclude or only, got %q", sval)
+		}
+	}
+
+	if sval, ok := optionValue(p, "min_access_level"); ok {
+		level, err := parseAccessLevel(sval)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("min_access_level: %v", err)
+		}
+		opts.MinAccessLevel = level
+	}
+
+	opts.IncludeProjects = optionList(p, "include_projects")
+	opts.ExcludeProjects = optionList(p, "exclude_projects")
+
+	opts.Subtrees = optionList(p, "subtrees")
+	for _, name := range opts.Subtrees {
+		if !isSubtree(name) {
+			log.Fatalf("subtrees: unknown subtree %q (expected one of %s)",
+				name, strings.Join(gitlabfs.AllSubtrees, ", "))
 		}
-		opts.MinJobsDirUpdateDelay = dur
 	}
 
 	return opts
 }
 
+// Artifact caches by directory, so instances configured to use the same one
+// share it
+var artifactCaches = make(map[string]*gitlabfs.ArtifactCache)
+
+func openArtifactCache(dir string, maxSize int64) *gitlabfs.ArtifactCache {
+	dir = filepath.Clean(dir)
+	if cache, ok := artifactCaches[dir]; ok {
+		return cache
+	}
+
+	cache, err := gitlabfs.NewArtifactCache(dir, maxSize)
+	if err != nil {
+		log.Fatalf("Failed to open artifact cache: %v", err)
+	}
+	artifactCaches[dir] = cache
+	return cache
+}
+
+func isSubtree(name string) bool {
+	for _, s := range gitlabfs.AllSubtrees {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// profileToken returns the token from the profile's token source, if it has
+// one: the token itself, a file holding it, an environment variable, or a
+// command printing it.
+func profileToken(p profile) (string, error) {
+	if token, ok := p.str("token"); ok {
+		return token, nil
+	}
+	if path, ok := p.str("token_file"); ok {
+		buf, err := ioutil.ReadFile(expandHome(path))
+		return strings.TrimSpace(string(buf)), err
+	}
+	if name, ok := p.str("token_env"); ok {
+		return os.Getenv(name), nil
+	}
+	if command, ok := p.str("token_command"); ok {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	return "", nil
+}
+
+// applyProfile takes the URL, token and debug settings which were set by
+// neither a flag nor an environment variable from the profile. setFlags holds
+// the names of the flags which were given.
+func applyProfile(p profile, setFlags map[string]bool, url, token *string, debug, fusedebug *bool) error {
+	var err error
+	if *url == "" {
+		*url, _ = p.str("url")
+	}
+	if *token == "" && len(p.list("instances")) == 0 {
+		if *token, err = profileToken(p); err != nil {
+			return fmt.Errorf("Failed to get GitLab token: %v", err)
+		}
+	}
+	if !setFlags["debug"] {
+		if *debug, err = p.bool("debug", false); err != nil {
+			return err
+		}
+	}
+	if !setFlags["fusedebug"] {
+		if *fusedebug, err = p.bool("fusedebug", false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountedFs is a GitlabFs, or several of them in a MultiFs.
+type mountedFs interface {
+	Root() nodefs.Node
+	ResyncJobs()
+	Refresh()
+}
+
+// newGitlabClient creates a client for one GitLab instance, which retries
+// failed requests using opts.RetryTransport, and counts them in opts.Stats.
+func newGitlabClient(url, token string, opts *gitlabfs.Options) (*gitlab.Client, error) {
+	transport := gitlabfs.NewRetryTransport(http.DefaultTransport, opts.MaxAttempts)
+	opts.RetryTransport = transport
+
+	options := []gitlab.ClientOptionFunc{
+		gitlab.WithBaseURL(url),
+		gitlab.WithHTTPClient(&http.Client{Transport: opts.Stats.Transport(transport)}),
+		gitlab.WithoutRetries(),
+	}
+
+	if opts.RequestsPerSecond != 0 {
+		options = append(options, gitlab.WithCustomLimiter(gitlabfs.NewRateLimiter(opts.RequestsPerSecond)))
+	}
+
+	return gitlab.NewClient(token, options...)
+}
+
+// newGitlabFs creates the filesystem of one GitLab instance.
+func newGitlabFs(url, token string, p profile, debug bool) *gitlabfs.GitlabFs {
+	opts := getGitlabFsOpts(p)
+	git, err := newGitlabClient(url, token, opts)
+	if err != nil {
+		log.Fatalf("Failed to get GitLab client: %v", err)
+	}
+
+	fs := gitlabfs.NewGitlabFs(git, opts)
+	if debug {
+		fs.SetDebugLogOutput(os.Stderr)
+	}
+	return fs
+}
+
+// checkAccess exits if GitLab cannot be reached, or rejects the credentials,
+// rather than leaving a mount where every access fails.
+func checkAccess(fs *gitlabfs.GitlabFs, url string) {
+	err := fs.CheckAccess()
+	if err == nil {
+		return
+	}
+
+	log.Print(accessErrorText(url, err))
+	if gitlabfs.IsAuthError(err) {
+		os.Exit(exitAuth)
+	}
+	os.Exit(exitUnreachable)
+}
+
+func accessErrorText(url string, err error) string {
+	if gitlabfs.IsAuthError(err) {
+		return fmt.Sprintf("GitLab at %s rejected the token (it may be invalid, expired or lack the read_api scope): %v", url, err)
+	}
+	return fmt.Sprintf("Failed to reach GitLab at %s: %v", url, err)
+}
+
+// newMultiFs creates a filesystem holding the instances configured in the
+// named profiles, each in a directory named after its host. It returns the
+// filesystem and the URLs of the instances.
+func newMultiFs(configPath string, names []string, debug bool) (*gitlabfs.MultiFs, []string) {
+	instances := make(map[string]*gitlabfs.GitlabFs)
+	var urls []string
+
+	for _, name := range names {
+		p, err := loadProfile(configPath, name, true)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+
+		rawurl, _ := p.str("url")
+		if rawurl == "" {
+			log.Fatalf("Instance %q: GitLab URL not set", name)
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Host == "" {
+			log.Fatalf("Instance %q: invalid GitLab URL %q", name, rawurl)
+		}
+		if _, ok := instances[u.Host]; ok {
+			log.Fatalf("Instance %q: %s is already mounted", name, u.Host)
+		}
+
+		token, err := profileToken(p)
+		if err != nil {
+			log.Fatalf("Instance %q: failed to get GitLab token: %v", name, err)
+		}
+		if token == "" {
+			log.Fatalf("Instance %q: GitLab token not set", name)
+		}
+
+		instDebug, err := p.bool("debug", false)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// One instance being down or misconfigured mustn't keep the others
+		// from being mounted
+		fs := newGitlabFs(rawurl, token, p, debug || instDebug)
+		if err := fs.CheckAccess(); err != nil {
+			log.Printf("Instance %q: %s; mounting it anyway", name, accessErrorText(rawurl, err))
+		}
+
+		instances[u.Host] = fs
+		urls = append(urls, rawurl)
+	}
+
+	return gitlabfs.NewMultiFs(instances), urls
+}
+
 func main() {
 	// Parse arguments
 	url := flag.String("url", os.Getenv("GITLAB_URL"), "GitLab URL")
 	token := flag.String("token", os.Getenv("GITLAB_PRIVATE_TOKEN"), "GitLab private token")
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	fusedebug := flag.Bool("fusedebug", false, "Enable FUSE debug logging")
+	configPath := flag.String("config", defaultConfigPath(), "Config file")
+	profileName := flag.String("profile", os.Getenv("GITLABFS_PROFILE"), "Config file profile to use")
 	flag.Parse()
 
 	if len(flag.Args()) < 1 {
 		log.Fatal("Usage: gitlab-fuse mountpoint")
 	}
-	if *url == "" {
-		log.Fatal("GitLab URL not set (via GITLAB_URL or -url)")
-	}
-	if *token == "" {
-		log.Fatal("GitLab token not set (via GITLAB_PRIVATE_TOKEN or -token)")
-	}
 	mountpoint := flag.Arg(0)
 
-	// Create GitLab client
-	git, err := gitlab.NewClient(*token, gitlab.WithBaseURL(*url))
+	// Settings from the config file only apply where neither a flag nor an
+	// environment variable was given
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	prof, err := loadProfile(*configPath, *profileName, setFlags["config"])
 	if err != nil {
-		log.Fatalf("Failed to get GitLab client: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Create GitlabFs
-	fs := gitlabfs.NewGitlabFs(git, getGitlabFsOpts())
-	if *debug {
-		fs.SetDebugLogOutput(os.Stderr)
+	if err := applyProfile(prof, setFlags, url, token, debug, fusedebug); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the filesystem
+	var fs mountedFs
+	fsName := *url
+	if names := prof.list("instances"); len(names) != 0 {
+		// Each instance has its own URL and token
+		if setFlags["url"] || setFlags["token"] {
+			log.Fatal("-url and -token can't be used with a profile listing instances")
+		}
+		multi, urls := newMultiFs(*configPath, names, *debug)
+		fs = multi
+		fsName = strings.Join(urls, ",")
+	} else {
+		if *url == "" {
+			log.Fatal("GitLab URL not set (via GITLAB_URL, -url or the config file)")
+		}
+		if *token == "" {
+			log.Fatal("GitLab token not set (via GITLAB_PRIVATE_TOKEN, -token or the config file)")
+		}
+		single := newGitlabFs(*url, *token, prof, *debug)
+		checkAccess(single, *url)
+		fs = single
 	}
 
 	// Create FS connector
@@ -97,17 +517,19 @@ func main() {
 
 	// Create the FUSE server
 	mntOpts := &fuse.MountOptions{
-		Debug:          *fusedebug,
-		FsName:         *url,
-		Name:           "gitlab",
-		SingleThreaded: true,
+		Debug:  *fusedebug,
+		FsName: fsName,
+		Name:   "gitlab",
 	}
 	server, err := fuse.NewServer(conn.RawFS(), mountpoint, mntOpts)
 	if err != nil {
-		log.Fatalf("Mount fail: %v\n", err)
+		log.Printf("Mount fail: %v\n", err)
+		os.Exit(exitMount)
 	}
 
 	// Run!
 	handleSigint(server, mountpoint)
+	handleSighup(fs)
+	handleSigusr1(fs)
 	server.Serve()
 }